@@ -2,192 +2,261 @@ package controllers
 
 import (
 	"context"
-	"fmt"
 	"net/http"
 	"time"
 
+	"github.com/GadirB/ecommerce-go/database"
+	"github.com/GadirB/ecommerce-go/dto"
 	"github.com/GadirB/ecommerce-go/models"
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func AddAddress() gin.HandlerFunc{
-	return func (c *gin.Context)  {
-		user_id := c.Query("id")
-		if user_id == ""{
-			c.Header("Content-Type", "application/json")
-			c.JSON(http.StatusNotFound, gin.H{"Error": "Invalid Code"})
-			c.Abort()
-			return 
-		} 
-		address, err := primitive.ObjectIDFromHex(user_id)
-		if err != nil {
-			c.IndentedJSON(500, "Internal Server Error")
-		} 
-
-		var addresses models.Address
+var errInvalidAddressID = database.InvalidInput("address id is not valid")
+
+// addressPatchRequest is the body of PATCH /addresses/:id; only the fields
+// that are present are changed. A default flag can only be set: it is
+// cleared by setting it on another address. The changed address is
+// validated as a whole, since what is valid depends on its country.
+type addressPatchRequest struct {
+	Label *string `json:"label"`
+	Recipient_Name *string `json:"recipient_name"`
+	Phone *string `json:"phone"`
+	House *string `json:"house_name"`
+	Street *string `json:"street_name"`
+	Line_2 *string `json:"line_2"`
+	City *string `json:"city_name"`
+	Region *string `json:"region"`
+	Postal_Code *string `json:"postal_code"`
+	Country *string `json:"country"`
+	Default_Shipping *bool `json:"default_shipping"`
+	Default_Billing *bool `json:"default_billing"`
+}
 
-		addresses.Address_ID = primitive.NewObjectID()
+// apply returns address with the patch applied.
+func (p addressPatchRequest) apply(address models.Address) models.Address {
+	patched := []struct {
+		value *string
+		field **string
+	}{
+		{p.Label, &address.Label},
+		{p.Recipient_Name, &address.Recipient_Name},
+		{p.Phone, &address.Phone},
+		{p.House, &address.House},
+		{p.Street, &address.Street},
+		{p.Line_2, &address.Line_2},
+		{p.City, &address.City},
+		{p.Region, &address.Region},
+		{p.Postal_Code, &address.Postal_Code},
+		{p.Country, &address.Country},
+	}
+	for _, patch := range patched {
+		if patch.value != nil {
+			*patch.field = patch.value
+		}
+	}
+	if p.Default_Shipping != nil && *p.Default_Shipping {
+		address.Default_Shipping = true
+	}
+	if p.Default_Billing != nil && *p.Default_Billing {
+		address.Default_Billing = true
+	}
+	normalizeAddress(&address)
+	return address
+}
 
-		if err = c.BindJSON(&addresses); err != nil {
-			c.IndentedJSON(http.StatusNotAcceptable, err.Error())
+// fields lists the patched fields of address, the result of apply, by
+// their bson names.
+func (p addressPatchRequest) fields(address models.Address) bson.D {
+	fields := bson.D{}
+	add := func(present bool, key string, value interface{}) {
+		if present {
+			fields = append(fields, bson.E{Key: key, Value: value})
 		}
+	}
+	add(p.Label != nil, "label", address.Label)
+	add(p.Recipient_Name != nil, "recipient_name", address.Recipient_Name)
+	add(p.Phone != nil, "phone", address.Phone)
+	add(p.House != nil, "house_name", address.House)
+	add(p.Street != nil, "street_name", address.Street)
+	add(p.Line_2 != nil, "line_2", address.Line_2)
+	add(p.City != nil, "city_name", address.City)
+	add(p.Region != nil, "region", address.Region)
+	add(p.Postal_Code != nil, "postal_code", address.Postal_Code)
+	add(p.Country != nil, "country", address.Country)
+	add(p.Default_Shipping != nil && *p.Default_Shipping, "default_shipping", true)
+	add(p.Default_Billing != nil && *p.Default_Billing, "default_billing", true)
+	return fields
+}
 
-		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+// bindAddress binds an address from the body, normalizes it and checks it
+// against the rules of its country.
+func bindAddress(c *gin.Context, address *models.Address) bool {
+	if err := c.ShouldBindJSON(address); err != nil {
+		fail(c, errInvalidBody)
+		return false
+	}
+	normalizeAddress(address)
+	if validationErr := Validate.Struct(address); validationErr != nil {
+		fail(c, validationErr)
+		return false
+	}
+	return true
+}
 
-		match_filter := bson.D{{Key: "$match", Value: bson.D{primitive.E{Key: "_id", Value: address}}}}
-		unwind := bson.D{{Key: "$unwind", Value: bson.D{primitive.E{Key: "path", Value: "$address"}}}}
-		group := bson.D{{Key: "$group", Value: bson.D{primitive.E{Key: "_id", Value: "$address_id"}, {Key: "count", Value: bson.D{primitive.E{Key: "$sum", Value: 1}}}}}}
+func addressIDParam(c *gin.Context) (primitive.ObjectID, bool) {
+	addressID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		fail(c, errInvalidAddressID)
+		return addressID, false
+	}
+	return addressID, true
+}
 
-		pointCursor, err := userCollection.Aggregate(ctx, mongo.Pipeline{match_filter, unwind, group})
+func (app *Application) ListAddresses() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := currentUserID(c)
+		if !ok {
+			return
+		}
 
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		addresses, err := database.ListAddresses(ctx, app.userCollection, userID)
 		if err != nil {
-			c.IndentedJSON(500, "Internal Server Error")
-			return 
+			fail(c, err)
+			return
 		}
 
-		var addressInfo []bson.M
-		if err = pointCursor.All(ctx, &addressInfo); err != nil {
-			panic(err)
+		c.JSON(http.StatusOK, gin.H{
+			"addresses": dto.NewAddresses(addresses),
+			"max_addresses": database.MaxAddresses,
+		})
+	}
+}
+
+func (app *Application) GetAddress() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := currentUserID(c)
+		if !ok {
+			return
 		}
 
-		var size int32
-		for _, address_no := range addressInfo {
-		count := address_no["count"]
-		size = count.(int32)
+		addressID, ok := addressIDParam(c)
+		if !ok {
+			return
 		}
 
-		if size < 2 {
-			filter := bson.D{primitive.E{Key: "_id", Value: address}}
-			update := bson.D{{Key: "$push", Value: bson.D{primitive.E{Key: "address", Value: addresses}}}}
-			_, err := userCollection.UpdateOne(ctx, filter, update)
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
 
-			if err != nil {
-				fmt.Println(err)
-			}
-		} else {
-			c.IndentedJSON(400, "Not Allowed")
+		address, err := database.GetAddress(ctx, app.userCollection, userID, addressID)
+		if err != nil {
+			fail(c, err)
+			return
 		}
 
-		defer cancel()
-		ctx.Done()
+		c.JSON(http.StatusOK, dto.NewAddress(address))
 	}
 }
 
-func EditHomeAddress() gin.HandlerFunc{
-    return func (c *gin.Context)  {
-		user_id := c.Query("id")
-		
-		if user_id == ""{
-			c.Header("Content-Type", "application/json")
-			c.JSON(http.StatusNotFound, gin.H{"Error": "Invalid"})
-			c.Abort()
-			return 
-		}
-
-		usert_id, err := primitive.ObjectIDFromHex(user_id)
-		if err != nil {
-			c.IndentedJSON(500, "Internal Server Error")
-			return 
+// AddAddress adds an address to the user's book, up to
+// database.MaxAddresses of them.
+func (app *Application) AddAddress() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := currentUserID(c)
+		if !ok {
+			return
 		}
 
-		var editAddress models.Address
-
-		if err := c.BindJSON(&editAddress); err != nil {
-			c.IndentedJSON(http.StatusBadRequest, err.Error())
+		var address models.Address
+		if !bindAddress(c, &address) {
+			return
 		}
 
-		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		filter := bson.D{primitive.E{Key: "_id", Value: usert_id}}
-		update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "address.1.house_name", Value: editAddress.House}, {Key: "address.1.street_name", Value: editAddress.Street}, {Key: "address.1.city_name", Value: editAddress.City}, {Key:"address.1.pin_code", Value: editAddress.Pincode}}}}
 
-		_, err = userCollection.UpdateOne(ctx, filter, update)
+		address, err := database.AddAddress(ctx, app.userCollection, userID, address)
 		if err != nil {
-			c.IndentedJSON(500, "Wrong Command")
-			return 
+			fail(c, err)
+			return
 		}
-		defer cancel()
-		ctx.Done()
-		c.IndentedJSON(200, "successfully updated")
+
+		c.JSON(http.StatusCreated, dto.NewAddress(address))
 	}
 }
 
-func EditWorkAddress() gin.HandlerFunc{
-    return func (c *gin.Context)  {
-		user_id := c.Query("id")
-		
-		if user_id == ""{
-			c.Header("Content-Type", "application/json")
-			c.JSON(http.StatusNotFound, gin.H{"Error": "Invalid"})
-			c.Abort()
-			return 
+func (app *Application) UpdateAddress() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := currentUserID(c)
+		if !ok {
+			return
 		}
 
-		usert_id, err := primitive.ObjectIDFromHex(user_id)
-		if err != nil {
-			c.IndentedJSON(500, "Internal Server Error")
-			return 
+		addressID, ok := addressIDParam(c)
+		if !ok {
+			return
 		}
 
-		var editAddress models.Address
-
-		if err := c.BindJSON(&editAddress); err != nil {
-			c.IndentedJSON(http.StatusBadRequest, err.Error())
+		var patch addressPatchRequest
+		if !bindRequest(c, &patch) {
+			return
 		}
 
-		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		filter := bson.D{primitive.E{Key: "_id", Value: usert_id}}
-		update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "address.0.house_name", Value: editAddress.House}, {Key: "address.0.street_name", Value: editAddress.Street}, {Key: "address.0.city_name", Value: editAddress.City}, {Key:"address.0.pin_code", Value: editAddress.Pincode}}}}
 
-		_, err = userCollection.UpdateOne(ctx, filter, update)
+		current, err := database.GetAddress(ctx, app.userCollection, userID, addressID)
+		if err != nil {
+			fail(c, err)
+			return
+		}
+
+		patched := patch.apply(current)
+		if validationErr := Validate.Struct(patched); validationErr != nil {
+			fail(c, validationErr)
+			return
+		}
+
+		fields := patch.fields(patched)
+		if len(fields) == 0 {
+			fail(c, database.InvalidInput("no fields to update"))
+			return
+		}
 
+		address, err := database.UpdateAddress(ctx, app.userCollection, userID, addressID, fields)
 		if err != nil {
-			c.IndentedJSON(500, "Wrong Command")
-			return 
+			fail(c, err)
+			return
 		}
 
-		defer cancel()
-		ctx.Done()
-		c.IndentedJSON(200, "successfully updated")
+		c.JSON(http.StatusOK, dto.NewAddress(address))
 	}
 }
 
-func DeleteAddress() gin.HandlerFunc{
-	return func (c *gin.Context)  {
-		user_id := c.Query("id")
-		
-		if user_id == ""{
-			c.Header("Content-Type", "application/json")
-			c.JSON(http.StatusNotFound, gin.H{"Error": "Invalid Search Index"})
-			c.Abort()
-			return 
+func (app *Application) DeleteAddress() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := currentUserID(c)
+		if !ok {
+			return
 		}
 
-		addresses := make([]models.Address, 0)
-		usert_id, err := primitive.ObjectIDFromHex(user_id)
-		if err != nil {
-			c.IndentedJSON(500, "Internal Server Error")
-			return 
+		addressID, ok := addressIDParam(c)
+		if !ok {
+			return
 		}
 
-		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		filter := bson.D{primitive.E{Key: "_id", Value: usert_id}}
-		update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "address", Value: addresses}}}}
-
-		_, err = userCollection.UpdateOne(ctx, filter, update)
 
-		if err != nil {
-			c.IndentedJSON(404, "Wrong Command")
-			return 
+		if err := database.DeleteAddress(ctx, app.userCollection, userID, addressID); err != nil {
+			fail(c, err)
+			return
 		}
 
-		defer cancel()
-		ctx.Done()
-		c.IndentedJSON(200, "Successfully Deleted")
+		c.JSON(http.StatusOK, gin.H{"message": "address deleted"})
 	}
-}
\ No newline at end of file
+}
@@ -2,63 +2,120 @@ package controllers
 
 import (
 	"context"
-	"errors"
-	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/GadirB/ecommerce-go/database"
-	"github.com/GadirB/ecommerce-go/models"
+	"github.com/GadirB/ecommerce-go/dto"
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+// maxCartLineQuantity caps how many units of one product a cart line can hold.
+const maxCartLineQuantity = 99
+
 type Application struct {
 	productCollection *mongo.Collection
 	userCollection *mongo.Collection
+	orderCollection *mongo.Collection
+	reservationCollection *mongo.Collection
 }
 
-func NewApplication(productCollection *mongo.Collection, userCollection *mongo.Collection) *Application {
+func NewApplication(productCollection *mongo.Collection, userCollection *mongo.Collection, orderCollection *mongo.Collection, reservationCollection *mongo.Collection) *Application {
 	return &Application{
 		productCollection: productCollection,
 		userCollection: userCollection,
+		orderCollection: orderCollection,
+		reservationCollection: reservationCollection,
+	}
+}
+
+// currentUserID returns the id of the user the request acts for, as set by
+// middleware.Authentication (or middleware.Impersonation). It fails the
+// request with a 401 and returns false when there is none.
+func currentUserID(c *gin.Context) (string, bool) {
+	userID := c.GetString("uid")
+	if userID == "" {
+		fail(c, errUserIDMissing)
+		return "", false
+	}
+	return userID, true
+}
+
+// ownUserID is currentUserID for actions only the account holder may take,
+// such as changing credentials. It refuses impersonated requests.
+func ownUserID(c *gin.Context) (string, bool) {
+	if c.GetString("actor_uid") != "" {
+		fail(c, errActingAsUser)
+		return "", false
+	}
+	return currentUserID(c)
+}
+
+// queryObjectID reads an optional id from the query string.
+func queryObjectID(c *gin.Context, param string) (*primitive.ObjectID, bool) {
+	value := c.Query(param)
+	if value == "" {
+		return nil, true
+	}
+	id, err := primitive.ObjectIDFromHex(value)
+	if err != nil {
+		fail(c, database.InvalidInput(param+" is not valid"))
+		return nil, false
 	}
+	return &id, true
+}
+
+// addressChoice reads the shipping_address_id and billing_address_id query
+// parameters of a checkout. Either may be left out to use the default
+// address.
+func addressChoice(c *gin.Context) (database.AddressChoice, bool) {
+	var choice database.AddressChoice
+	var ok bool
+	if choice.Shipping_Address_ID, ok = queryObjectID(c, "shipping_address_id"); !ok {
+		return choice, false
+	}
+	if choice.Billing_Address_ID, ok = queryObjectID(c, "billing_address_id"); !ok {
+		return choice, false
+	}
+	return choice, true
 }
 
 func (app *Application) AddToCart() gin.HandlerFunc{
 	return func (c *gin.Context)  {
 		productQueryID := c.Query("id")
 		if productQueryID == "" {
-			log.Println("product id is empty")
-
-			_ = c.AbortWithError(http.StatusBadRequest, errors.New("product id is empty"))
+			fail(c, database.InvalidInput("product id is empty"))
 			return 
 		}
 		
-		userQueryID := c.Query("userID")
-		if userQueryID == "" {
-			log.Println("user id is empty")
-			_ = c.AbortWithError(http.StatusBadRequest, errors.New("user id is empty"))
-			return 
+		userID, ok := currentUserID(c)
+		if !ok {
+			return
 		}
 		
 		productID, err := primitive.ObjectIDFromHex(productQueryID)
 
 		if err!= nil {
-			log.Println(err)
-			c.AbortWithStatus(http.StatusInternalServerError)
+			fail(c, errInvalidProductID)
 			return 
 		}
 
+		quantity, err := strconv.Atoi(c.DefaultQuery("quantity", "1"))
+		if err != nil || quantity < 1 || quantity > maxCartLineQuantity {
+			fail(c, database.ErrInvalidQuantity)
+			return
+		}
+
 		var ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
 
 		defer cancel()
 
-		err = database.AddProductToCart(ctx, app.productCollection, app.userCollection, productID, userQueryID)
+		err = database.AddProductToCart(ctx, app.productCollection, app.userCollection, app.reservationCollection, productID, userID, quantity)
 		if err!= nil {
-			c.IndentedJSON(http.StatusInternalServerError, err)
+			fail(c, err)
 			return
 		}
 		c.IndentedJSON(200, "product added to cart")
@@ -69,24 +126,19 @@ func (app *Application) RemoveItem() gin.HandlerFunc{
 	return func (c *gin.Context)  {
 		productQueryID := c.Query("id")
 		if productQueryID == "" {
-			log.Println("product id is empty")
-
-			_ = c.AbortWithError(http.StatusBadRequest, errors.New("product id is empty"))
+			fail(c, database.InvalidInput("product id is empty"))
 			return 
 		}
 		
-		userQueryID := c.Query("userID")
-		if userQueryID == "" {
-			log.Println("user id is empty")
-			_ = c.AbortWithError(http.StatusBadRequest, errors.New("user id is empty"))
-			return 
+		userID, ok := currentUserID(c)
+		if !ok {
+			return
 		}
 		
 		productID, err := primitive.ObjectIDFromHex(productQueryID)
 
 		if err!= nil {
-			log.Println(err)
-			c.AbortWithStatus(http.StatusInternalServerError)
+			fail(c, errInvalidProductID)
 			return 
 		}
 
@@ -94,107 +146,104 @@ func (app *Application) RemoveItem() gin.HandlerFunc{
 
 		defer cancel()
 
-		err = database.RemoveCartItem(ctx, app.productCollection, app.userCollection, productID, userQueryID)
+		err = database.RemoveCartItem(ctx, app.productCollection, app.userCollection, app.reservationCollection, productID, userID)
 
 		if err != nil {
-			c.IndentedJSON(http.StatusInternalServerError, err)
+			fail(c, err)
 			return
 		}
 		c.IndentedJSON(200, "item removed from cart")
 	}
 }
 
-func GetItemFromCart() gin.HandlerFunc{
-	return func (c *gin.Context)  {
-		user_id := c.Query("id")
+type cartQuantityRequest struct {
+	Quantity *int `json:"quantity" validate:"required,min=0"`
+}
 
-		if user_id == "" {
-			c.Header("Content-Type", "application/json")
-			c.JSON(http.StatusNotFound, gin.H{"Error": "Invalid ID"})
-			c.Abort()
-			return 
+func (app *Application) SetCartItemQuantity() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := currentUserID(c)
+		if !ok {
+			return
 		}
-		
-		usert_id, _ := primitive.ObjectIDFromHex(user_id)
-		
-		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
-		defer cancel()
 
-		userCollection := database.UserData(database.Client, "Users")
+		productID, err := primitive.ObjectIDFromHex(c.Param("productId"))
+		if err != nil {
+			fail(c, errInvalidProductID)
+			return
+		}
 
-		var filledCart models.User
-		err := userCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: usert_id}}).Decode(&filledCart)
+		var request cartQuantityRequest
+		if !bindRequest(c, &request) {
+			return
+		}
+		if *request.Quantity > maxCartLineQuantity {
+			fail(c, database.ErrInvalidQuantity)
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
 
+		err = database.SetCartItemQuantity(ctx, app.productCollection, app.userCollection, app.reservationCollection, productID, userID, *request.Quantity)
 		if err != nil {
-			log.Println(err)
-			c.IndentedJSON(500, "Not Found")
+			fail(c, err)
 			return
 		}
 
-		filter_match := bson.D{{Key: "$match", Value: bson.D{primitive.E{Key: "_id", Value: usert_id}}}}
-		unwind := bson.D{{Key: "$unwind", Value: bson.D{primitive.E{Key: "path", Value: "$usercart"}}}}
-		grouping := bson.D{{Key: "$group", Value: bson.D{primitive.E{Key: "_id", Value: "$_id"}, {Key: "total", Value: bson.D{primitive.E{Key: "$sum", Value: "$usercart.price"}}}}}}
+		if *request.Quantity == 0 {
+			c.JSON(http.StatusOK, gin.H{"message": "item removed from cart"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "cart item updated", "quantity": *request.Quantity})
+	}
+}
 
-		pointCursor, err := userCollection.Aggregate(ctx, mongo.Pipeline{filter_match, unwind, grouping})
+func GetItemFromCart() gin.HandlerFunc{
+	return func (c *gin.Context)  {
+		user_id, ok := currentUserID(c)
+		if !ok {
+			return
+		}
 
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		userCollection := database.UserData(database.Client, "Users")
+
+		items, pricing, err := database.GetCart(ctx, userCollection, productCollection, user_id)
 		if err != nil {
-			log.Println(err)
-		}
-
-		var listing []bson.M
-		if err = pointCursor.All(ctx, &listing); err != nil {
-			log.Println(err)
-			c.AbortWithStatus(http.StatusInternalServerError)
-		}
-
-		var total int = 0
-		if len(listing) > 0 {
-			log.Println("Aggregate result:", listing[0])
-			
-			if totalValue, ok := listing[0]["total"].(int32); ok {
-				total = int(totalValue)
-				log.Println("Total successfully converted from int32:", total)
-			} else {
-				log.Printf("Total is not int32, actual type: %T, value: %v", listing[0]["total"], listing[0]["total"])
-				
-				for _, item := range filledCart.UserCart {
-					total += item.Price
-				}
-				log.Println("Used fallback calculation, total:", total)
-			}
-		}
-
-		c.JSON(200, gin.H{
-			"cart_items": filledCart.UserCart,
-			"total_price": total,
-			"total_items": len(filledCart.UserCart),
-		})
-
-		ctx.Done()
+			fail(c, err)
+			return
+		}
+
+		c.JSON(200, dto.NewCart(items, pricing))
 	}
 }
 
 func (app *Application) BuyFromCart() gin.HandlerFunc{
 	return func (c *gin.Context)  {
-		userQueryID := c.Query("id")
+		userID, ok := currentUserID(c)
+		if !ok {
+			return
+		}
 
-		if userQueryID == "" {
-			log.Panicln("user id is empty")
-			_ = c.AbortWithError(http.StatusBadRequest, errors.New("UserID is empty"))
-			return 
+		addresses, ok := addressChoice(c)
+		if !ok {
+			return
 		}
 
 		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
 
 		defer cancel()
 
-		err := database.BuyItemFromCart(ctx, app.userCollection, userQueryID)
+		order, err := database.BuyItemFromCart(ctx, app.productCollection, app.userCollection, app.orderCollection, app.reservationCollection, userID, addresses)
 		if err != nil {
-			c.IndentedJSON(http.StatusInternalServerError, err)
+			fail(c, err)
 			return
 		}
 
-		c.IndentedJSON(200, "items placed the order")
+		c.IndentedJSON(200, gin.H{"message": "items placed the order", "order_id": order.Order_ID})
 	}
 }
 
@@ -202,38 +251,38 @@ func (app *Application) InstantBuy() gin.HandlerFunc{
 	return func (c *gin.Context)  {
 		productQueryID := c.Query("id")
 		if productQueryID == "" {
-			log.Println("product id is empty")
-
-			_ = c.AbortWithError(http.StatusBadRequest, errors.New("product id is empty"))
+			fail(c, database.InvalidInput("product id is empty"))
 			return 
 		}
 		
-		userQueryID := c.Query("userID")
-		if userQueryID == "" {
-			log.Println("user id is empty")
-			_ = c.AbortWithError(http.StatusBadRequest, errors.New("user id is empty"))
-			return 
+		userID, ok := currentUserID(c)
+		if !ok {
+			return
 		}
 		
 		productID, err := primitive.ObjectIDFromHex(productQueryID)
 
 		if err!= nil {
-			log.Println(err)
-			c.AbortWithStatus(http.StatusInternalServerError)
+			fail(c, errInvalidProductID)
 			return 
 		}
 
+		addresses, ok := addressChoice(c)
+		if !ok {
+			return
+		}
+
 		var ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
 
 		defer cancel()
 
-		err = database.InstantBuyer(ctx, app.productCollection, app.userCollection, productID, userQueryID)
+		order, err := database.InstantBuyer(ctx, app.productCollection, app.userCollection, app.orderCollection, app.reservationCollection, productID, userID, addresses)
 
 		if err != nil {
-			c.IndentedJSON(http.StatusInternalServerError, err)
+			fail(c, err)
 			return
 		}
 
-		c.IndentedJSON(200, "product placed ther order")
+		c.IndentedJSON(200, gin.H{"message": "product placed the order", "order_id": order.Order_ID})
 	}
 }
\ No newline at end of file
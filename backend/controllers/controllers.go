@@ -2,15 +2,17 @@ package controllers
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/GadirB/ecommerce-go/database"
+	"github.com/GadirB/ecommerce-go/dto"
 	"github.com/GadirB/ecommerce-go/models"
 	"github.com/gin-gonic/gin"
-	"github.com/go-playground/validator/v10"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -20,7 +22,8 @@ import (
 
 var userCollection *mongo.Collection = database.UserData(database.Client, "Users")
 var productCollection *mongo.Collection = database.ProductData(database.Client, "Products")
-var Validate = validator.New()
+var loginThrottleCollection *mongo.Collection = database.LoginThrottleData(database.Client, "LoginThrottles")
+var Validate = newValidator()
 
 func HashPassword (password string) string{
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
@@ -48,25 +51,18 @@ func SignUp () gin.HandlerFunc {
 		defer cancel()
 		
 		var user models.User
-		if err := c.BindJSON(&user); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if !bindRequest(c, &user) {
 			return
 		}
 
-		validationErr := Validate.Struct(user)
-		if validationErr != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr})
-			return
-		} 
-
 		count, err := userCollection.CountDocuments(ctx, bson.M{"email": user.Email})
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err})
+			fail(c, err)
 			return
 		}
 
 		if count > 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "user already exists"})
+			fail(c, database.ErrEmailInUse)
 			return 
 		}
 
@@ -74,13 +70,12 @@ func SignUp () gin.HandlerFunc {
 
 		defer cancel()
 		if err != nil {
-			log.Panic(err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err})
+			fail(c, err)
 			return
 		}
 
 		if count > 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "this phone is already in use"})
+			fail(c, database.ErrPhoneInUse)
 			return 
 		}
 
@@ -92,19 +87,25 @@ func SignUp () gin.HandlerFunc {
 		user.ID = primitive.NewObjectID()
 		user.User_ID = user.ID.Hex()
 
-		token, refreshToken, _ := generate.TokenGenerator(*user.Email, *user.First_Name, *user.Last_Name, user.User_ID)
+		user.Roles = []models.Role{models.RoleCustomer}
+		user.Email_Verified = false
+		user.Email_Verified_At = nil
+		user.Pending_Email = nil
+
+		token, refreshToken, _ := generate.TokenGenerator(*user.Email, *user.First_Name, *user.Last_Name, user.User_ID, user.Roles, []string{generate.AuthPassword})
 		user.Token = &token
 		user.Refresh_Token = &refreshToken
 		user.UserCart = make([]models.ProductUser, 0)
 		user.Address_Details = make([]models.Address, 0)
-		user.Order_Status = make([]models.Order, 0)
 
 		_, inserter := userCollection.InsertOne(ctx, user)
 		if inserter != nil {
 			log.Printf("Insert error: %v", inserter)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "user not created"})
+			fail(c, database.NewError(database.KindInternal, "cant_create_user", "user not created"))
 			return
 		}
+
+		go sendEmailVerification(user.User_ID, *user.Email)
 		
 		defer cancel()
 
@@ -112,146 +113,322 @@ func SignUp () gin.HandlerFunc {
 	}
 }
 
+type loginRequest struct {
+	Email string `json:"email" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+// dummyPasswordHash is compared against when the email is unknown, so that
+// a login takes as long whether or not the account exists.
+const dummyPasswordHash = "$2a$14$9zYhund3d.2D.B1674huhuihpWTfH24m5j7YTrlOFR3V9EtUByiE."
+
+var (
+	errLoginFailed = database.NewError(database.KindUnauthorized, "invalid_credentials", "invalid email or password")
+	errCantLogIn = database.NewError(database.KindInternal, "login_failed", "login failed")
+)
+
+// Login is throttled per account and per client address; see
+// database.CheckLogin. Unknown emails and wrong passwords get the same
+// answer.
 func Login() gin.HandlerFunc{
 	return func (c *gin.Context)  {
 		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
 		defer cancel()
 
-		var user models.User
+		var request loginRequest
 		var foundUser models.User
 
-		if err := c.BindJSON(&user); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err})
+		if !bindRequest(c, &request) {
 			return
 		}
 
-		err := userCollection.FindOne(ctx, bson.M{"email": user.Email}).Decode(&foundUser)
-		defer cancel()
-
+		retryAfter, err := database.CheckLogin(ctx, loginThrottleCollection, request.Email, c.ClientIP())
+		if errors.Is(err, database.ErrLoginLocked) {
+			c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			fail(c, err)
+			return
+		}
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "login failed"})
+			fail(c, err)
 			return
 		}
 
-		PasswordIsValid, msg := VerifyPassword(*user.Password, *foundUser.Password)
+		err = userCollection.FindOne(ctx, bson.M{"email": request.Email}).Decode(&foundUser)
+		if err != nil && err != mongo.ErrNoDocuments {
+			log.Println(err)
+			fail(c, errCantLogIn)
+			return
+		}
 
-		defer cancel()
+		hash := dummyPasswordHash
+		if err == nil && foundUser.Password != nil {
+			hash = *foundUser.Password
+		}
+		PasswordIsValid, _ := VerifyPassword(request.Password, hash)
 
-		if !PasswordIsValid {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
-			fmt.Println(msg)
+		if err != nil || !PasswordIsValid {
+			if recordErr := database.RecordLoginFailure(ctx, loginThrottleCollection, request.Email, c.ClientIP()); recordErr != nil {
+				log.Println(recordErr)
+			}
+			fail(c, errLoginFailed)
 			return
 		}
-		
-		token, refreshToken, _ := generate.TokenGenerator(*foundUser.Email, *foundUser.First_Name, *foundUser.Last_Name, foundUser.User_ID)
-		
+
+		// With 2FA on, failures stay counted until the second factor is
+		// given too; see LoginMFA.
+		if foundUser.MFA_Enabled {
+			mfaToken, err := generate.MFAPendingTokenGenerator(foundUser.User_ID)
+			if err != nil {
+				fail(c, errCantLogIn)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"mfa_required": true, "mfa_token": mfaToken})
+			return
+		}
+
+		completeLogin(c, ctx, foundUser, []string{generate.AuthPassword})
+	}
+}
+
+// completeLogin clears the account's failed logins and answers with a new
+// token pair.
+func completeLogin(c *gin.Context, ctx context.Context, foundUser models.User, authMethods []string) {
+	if err := database.ClearLoginFailures(ctx, loginThrottleCollection, *foundUser.Email); err != nil {
+		log.Println(err)
+	}
+
+	token, refreshToken, err := generate.TokenGenerator(*foundUser.Email, *foundUser.First_Name, *foundUser.Last_Name, foundUser.User_ID, database.EffectiveRoles(foundUser), authMethods)
+	if err != nil {
+		fail(c, errCantLogIn)
+		return
+	}
+
+	generate.UpdateAllTokens(token, refreshToken, foundUser.User_ID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"token": token,
+		"refresh_token": refreshToken,
+		"InsertedID": foundUser.User_ID,
+		"user": dto.NewUser(foundUser, database.EffectiveRoles(foundUser)),
+	})
+}
+
+type refreshRequest struct {
+	Refresh_Token string `json:"refresh_token" validate:"required"`
+}
+
+func RefreshToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 
-		generate.UpdateAllTokens(token, refreshToken, foundUser.User_ID)
+		var request refreshRequest
+		if !bindRequest(c, &request) {
+			return
+		}
+
+		token, refreshToken, err := generate.RefreshTokens(ctx, request.Refresh_Token)
+		if err != nil {
+			fail(c, err)
+			return
+		}
 
 		c.JSON(http.StatusOK, gin.H{
 			"token": token,
 			"refresh_token": refreshToken,
-			"InsertedID": foundUser.User_ID,
-			"user": foundUser,
 		})
 	}
 }
 
-func ProductViewerAdmin() gin.HandlerFunc {
+// JWKS publishes the public keys tokens are signed with, so other services
+// can verify them.
+func JWKS() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
-		var products models.Product
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, generate.Keys.JWKS())
+	}
+}
+
+type logoutRequest struct {
+	Refresh_Token string `json:"refresh_token"`
+}
+
+// Logout revokes the access token the request was made with and, when the
+// client sends it, the refresh token of the same session.
+func Logout() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := ownUserID(c); !ok {
+			return
+		}
+
+		value, _ := c.Get("claims")
+		claims, ok := value.(*generate.SignedDetails)
+		if !ok {
+			fail(c, errUserIDMissing)
+			return
+		}
+
+		var request logoutRequest
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&request); err != nil {
+				fail(c, errInvalidBody)
+				return
+			}
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		if err := c.BindJSON(&products); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+
+		if err := generate.RevokeAccessToken(ctx, claims); err != nil {
+			fail(c, err)
 			return
 		}
-		products.Product_ID = primitive.NewObjectID()
-		_, anyerr := productCollection.InsertOne(ctx, products)
-		if anyerr != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Not Created"})
+
+		if request.Refresh_Token != "" {
+			if err := generate.RevokeRefreshToken(ctx, request.Refresh_Token); err != nil {
+				fail(c, err)
+				return
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "logged out"})
+	}
+}
+
+// LogoutAll revokes every access and refresh token of the user, logging
+// them out on all devices.
+func LogoutAll() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := ownUserID(c)
+		if !ok {
 			return
 		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		c.JSON(http.StatusOK, "Successfully added our Product Admin!!")
+
+		if err := generate.RevokeAllUserTokens(ctx, userID); err != nil {
+			fail(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "logged out on all devices"})
 	}
 }
 
+// catalogFields reads the fields query parameter, a comma separated list of
+// dto.ProductFields. It returns the names asked for and the stored fields
+// to load for them, or nils when the parameter is absent.
+func catalogFields(c *gin.Context) ([]string, []string, bool) {
+	param := c.Query("fields")
+	if param == "" {
+		return nil, nil, true
+	}
 
+	var names, stored []string
+	for _, name := range strings.Split(param, ",") {
+		name = strings.TrimSpace(name)
+		source, known := dto.ProductFields[name]
+		if !known {
+			fail(c, database.InvalidInput("unknown field "+strconv.Quote(name)))
+			return nil, nil, false
+		}
+		names = append(names, name)
+		stored = append(stored, source...)
+	}
+	return names, stored, true
+}
+
+// SearchProduct lists the catalog a page at a time. The body is the page's
+// products; X-Total-Count has the size of the whole catalog, and while there
+// are more products X-Next-Cursor and a Link header with rel="next" say how
+// to get them.
 func SearchProduct() gin.HandlerFunc{
 	return func(c *gin.Context){
-		var productList []models.Product
-		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
-		defer cancel()
+		limit, err := strconv.ParseInt(c.DefaultQuery("limit", strconv.Itoa(defaultProductsPerPage)), 10, 64)
+		if err != nil || limit < 1 {
+			fail(c, database.InvalidInput("limit must be a positive number"))
+			return
+		}
+		if limit > maxProductsPerPage {
+			limit = maxProductsPerPage
+		}
 
-		cursor, err := productCollection.Find(ctx, bson.D{{}})
-		if err!= nil {
-			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "can't find product"})
+		fields, storedFields, ok := catalogFields(c)
+		if !ok {
 			return
 		}
 
-		err = cursor.All(ctx, &productList)
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
 
+		page, err := database.ListCatalog(ctx, productCollection, database.CatalogQuery{
+			Sort: c.Query("sort"),
+			Cursor: c.Query("cursor"),
+			Limit: limit,
+			Fields: storedFields,
+		})
 		if err != nil {
-			log.Println(err)
-			c.AbortWithStatus(http.StatusInternalServerError)
-			return 
+			fail(c, err)
+			return
 		}
 
-		defer cursor.Close(ctx)
+		c.Header("X-Total-Count", strconv.FormatInt(page.Total, 10))
+		if page.Next_Cursor != "" {
+			next := *c.Request.URL
+			query := next.Query()
+			query.Set("cursor", page.Next_Cursor)
+			next.RawQuery = query.Encode()
+			c.Header("X-Next-Cursor", page.Next_Cursor)
+			c.Header("Link", "<"+next.RequestURI()+">; rel=\"next\"")
+		}
 
-		if err := cursor.Err(); err != nil {
-			log.Println(err)
-			c.IndentedJSON(400, "invalid")
+		if fields != nil {
+			c.JSON(http.StatusOK, dto.NewPartialProducts(page.Products, fields))
 			return
 		}
-
-		defer cancel()
-		c.IndentedJSON(200, productList)
+		c.JSON(http.StatusOK, dto.NewProducts(page.Products))
 	}
 }
 
+// SearchProductByQuery searches product names. With prefix=true the last
+// word of name also matches the start of longer words, for typeahead.
 func SearchProductByQuery() gin.HandlerFunc{
 	return func (c *gin.Context)  {
-		var searchProducts []models.Product
 		queryParam := c.Query("name")
-
 		if queryParam == "" {
-			log.Println("query is empty")
-			c.Header("Content-Type", "application/json")
-			c.IndentedJSON(http.StatusNotFound, gin.H{"Error": "Invalid search index"})
-			c.Abort()
+			fail(c, database.InvalidInput("name is required"))
 			return 
 		}
 
-		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
-		defer cancel()
-
-		searchQueryDB, err := productCollection.Find(ctx, bson.M{"product_name": bson.M{"$regex":queryParam}})
-		
-		if err!= nil {
-			c.IndentedJSON(404, "can't find product")
+		prefix, err := strconv.ParseBool(c.DefaultQuery("prefix", "false"))
+		if err != nil {
+			fail(c, database.InvalidInput("prefix must be true or false"))
 			return
 		}
 
-		err = searchQueryDB.All(ctx, &searchProducts)
-		if err!= nil {
-			log.Println(err)
-			c.IndentedJSON(400, "invalid")
+		limit, err := strconv.ParseInt(c.DefaultQuery("limit", strconv.Itoa(defaultProductsPerPage)), 10, 64)
+		if err != nil || limit < 1 {
+			fail(c, database.InvalidInput("limit must be a positive number"))
 			return
 		}
+		if limit > maxProductsPerPage {
+			limit = maxProductsPerPage
+		}
 
-		defer searchQueryDB.Close(ctx)
-
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
 
-		if err := searchQueryDB.Err(); err != nil {
-			log.Println(err)
-			c.IndentedJSON(400, "invalid request")
-			return 
+		results, err := database.SearchProducts(ctx, productCollection, database.SearchQuery{
+			Text: queryParam,
+			Prefix: prefix,
+			Limit: limit,
+		})
+		if err != nil {
+			fail(c, err)
+			return
 		}
 
-		defer cancel()
-		c.IndentedJSON(200, searchProducts)
+		c.JSON(http.StatusOK, dto.NewSearchResults(results))
 	}
-}
\ No newline at end of file
+}
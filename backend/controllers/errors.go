@@ -0,0 +1,25 @@
+package controllers
+
+import (
+	"github.com/GadirB/ecommerce-go/database"
+	"github.com/gin-gonic/gin"
+)
+
+// Errors the handlers report themselves. Everything the database package
+// returns is already a database.Error.
+var (
+	errInvalidBody = database.NewError(database.KindInvalid, "invalid_body", "request body is not valid JSON")
+	errUserIDMissing = database.NewError(database.KindUnauthorized, "unauthenticated", "user id is missing from token")
+	errActingAsUser = database.NewError(database.KindForbidden, "impersonation_not_allowed", "this can't be done while acting as another user")
+	errCantRevokeSessions = database.NewError(database.KindInternal, "cant_revoke_sessions", "password changed, but existing sessions could not be ended")
+	errWrongPassword = database.NewError(database.KindInvalid, "wrong_password", "password is not valid")
+	errInvalidProductID = database.InvalidInput("product id is not valid")
+	errInvalidUserID = database.InvalidInput("user id is not valid")
+	errInvalidOrderID = database.InvalidInput("order id is not valid")
+)
+
+// fail aborts the request with err, which middleware.Errors renders.
+func fail(c *gin.Context, err error) {
+	_ = c.Error(err)
+	c.Abort()
+}
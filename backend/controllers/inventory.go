@@ -0,0 +1,40 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/GadirB/ecommerce-go/database"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type productStockRequest struct {
+	Stock *int `json:"stock" validate:"required,min=0"`
+}
+
+func (app *Application) SetProductStock() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		productID, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			fail(c, errInvalidProductID)
+			return
+		}
+
+		var request productStockRequest
+		if !bindRequest(c, &request) {
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err = database.SetProductStock(ctx, app.productCollection, productID, *request.Stock); err != nil {
+			fail(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "stock updated", "stock": *request.Stock})
+	}
+}
@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/GadirB/ecommerce-go/database"
+	"github.com/GadirB/ecommerce-go/models"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// UnlockAccount lifts a login lockout on a user's account. Lockouts of
+// client addresses expire on their own.
+func (app *Application) UnlockAccount() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			fail(c, database.ErrUserIdIsNotValid)
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var user models.User
+		err = app.userCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: id}}).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			fail(c, database.ErrUserIdIsNotValid)
+			return
+		}
+		if err != nil {
+			fail(c, err)
+			return
+		}
+
+		if err = database.UnlockAccount(ctx, loginThrottleCollection, *user.Email); err != nil {
+			fail(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "account unlocked"})
+	}
+}
@@ -0,0 +1,210 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/GadirB/ecommerce-go/database"
+	"github.com/GadirB/ecommerce-go/models"
+	"github.com/GadirB/ecommerce-go/totp"
+	generate "github.com/GadirB/ecommerce-go/tokens"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type mfaCodeRequest struct {
+	Code string `json:"code" validate:"required"`
+}
+
+// mfaDisableRequest needs the password and either an app code or a
+// recovery code.
+type mfaDisableRequest struct {
+	Password string `json:"password" validate:"required"`
+	Code string `json:"code" validate:"required_without=Recovery_Code"`
+	Recovery_Code string `json:"recovery_code"`
+}
+
+type mfaLoginRequest struct {
+	MFA_Token string `json:"mfa_token" validate:"required"`
+	Code string `json:"code" validate:"required_without=Recovery_Code"`
+	Recovery_Code string `json:"recovery_code"`
+}
+
+var (
+	errMFALoginExpired = database.NewError(database.KindUnauthorized, "mfa_login_expired", "login expired, please log in again")
+	errMFALoginFailed = database.NewError(database.KindUnauthorized, "invalid_mfa_code", "the code is not valid")
+)
+
+// verifySecondFactor checks an app code, or a recovery code if no app code
+// is given, and returns the auth method it proves.
+func verifySecondFactor(ctx context.Context, userID string, code string, recoveryCode string) (string, error) {
+	if code != "" {
+		return generate.AuthOTP, database.VerifyMFACode(ctx, userCollection, userID, code)
+	}
+	return generate.AuthRecoveryCode, database.UseRecoveryCode(ctx, userCollection, userID, recoveryCode)
+}
+
+// EnrollMFA starts turning on two-factor authentication. The secret and the
+// otpauth URI (to show as a QR code) go into the user's authenticator app;
+// 2FA is on once ConfirmMFA gets a code from it.
+func EnrollMFA() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := ownUserID(c)
+		if !ok {
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		secret, err := database.StartMFAEnrollment(ctx, userCollection, userID)
+		if err != nil {
+			fail(c, err)
+			return
+		}
+
+		issuer := os.Getenv("MFA_ISSUER")
+		if issuer == "" {
+			issuer = "Ecommerce"
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"secret": secret,
+			"otpauth_uri": totp.URI(issuer, c.GetString("email"), secret),
+		})
+	}
+}
+
+// ConfirmMFA turns two-factor authentication on and returns the recovery
+// codes. They are only shown this once.
+func ConfirmMFA() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := ownUserID(c)
+		if !ok {
+			return
+		}
+
+		var request mfaCodeRequest
+		if !bindRequest(c, &request) {
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		codes, err := database.ConfirmMFAEnrollment(ctx, userCollection, userID, request.Code)
+		if err != nil {
+			fail(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "two-factor authentication enabled", "recovery_codes": codes})
+	}
+}
+
+// DisableMFA turns off two-factor authentication. Wrong passwords and codes
+// count as failed logins.
+func (app *Application) DisableMFA() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := ownUserID(c)
+		if !ok {
+			return
+		}
+
+		var request mfaDisableRequest
+		if !bindRequest(c, &request) {
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		user, ok := app.checkPassword(c, ctx, userID, request.Password)
+		if !ok {
+			return
+		}
+
+		_, err := verifySecondFactor(ctx, userID, request.Code, request.Recovery_Code)
+		if errors.Is(err, database.ErrInvalidMFACode) {
+			if recordErr := database.RecordLoginFailure(ctx, loginThrottleCollection, *user.Email, c.ClientIP()); recordErr != nil {
+				log.Println(recordErr)
+			}
+		}
+		if err != nil {
+			fail(c, err)
+			return
+		}
+
+		if err = database.DisableMFA(ctx, app.userCollection, userID); err != nil {
+			fail(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "two-factor authentication disabled"})
+	}
+}
+
+// LoginMFA is the second step of logging in to an account with 2FA: it
+// takes the mfa_token from Login and a code from the authenticator app or a
+// recovery code. Wrong codes count as failed logins.
+func LoginMFA() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		defer cancel()
+
+		var request mfaLoginRequest
+		if !bindRequest(c, &request) {
+			return
+		}
+
+		claims, err := generate.ValidateMFAPendingToken(request.MFA_Token)
+		if err != nil {
+			fail(c, errMFALoginExpired)
+			return
+		}
+
+		id, err := primitive.ObjectIDFromHex(claims.Uid)
+		if err != nil {
+			fail(c, errMFALoginExpired)
+			return
+		}
+
+		var foundUser models.User
+		if err = userCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: id}}).Decode(&foundUser); err != nil {
+			fail(c, errMFALoginExpired)
+			return
+		}
+
+		retryAfter, err := database.CheckLogin(ctx, loginThrottleCollection, *foundUser.Email, c.ClientIP())
+		if errors.Is(err, database.ErrLoginLocked) {
+			c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			fail(c, err)
+			return
+		}
+		if err != nil {
+			fail(c, err)
+			return
+		}
+
+		method, err := verifySecondFactor(ctx, foundUser.User_ID, request.Code, request.Recovery_Code)
+		if errors.Is(err, database.ErrInvalidMFACode) {
+			if recordErr := database.RecordLoginFailure(ctx, loginThrottleCollection, *foundUser.Email, c.ClientIP()); recordErr != nil {
+				log.Println(recordErr)
+			}
+			fail(c, errMFALoginFailed)
+			return
+		}
+		if err != nil {
+			fail(c, err)
+			return
+		}
+
+		completeLogin(c, ctx, foundUser, []string{generate.AuthPassword, method})
+	}
+}
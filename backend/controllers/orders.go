@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/GadirB/ecommerce-go/database"
+	"github.com/GadirB/ecommerce-go/dto"
+	"github.com/GadirB/ecommerce-go/models"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultOrdersPerPage = 10
+	maxOrdersPerPage = 100
+)
+
+func (app *Application) ListOrders() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := currentUserID(c)
+		if !ok {
+			return
+		}
+
+		page, err := strconv.ParseInt(c.DefaultQuery("page", "1"), 10, 64)
+		if err != nil || page < 1 {
+			fail(c, database.InvalidInput("page must be a positive number"))
+			return
+		}
+
+		perPage, err := strconv.ParseInt(c.DefaultQuery("per_page", strconv.Itoa(defaultOrdersPerPage)), 10, 64)
+		if err != nil || perPage < 1 {
+			fail(c, database.InvalidInput("per_page must be a positive number"))
+			return
+		}
+		if perPage > maxOrdersPerPage {
+			perPage = maxOrdersPerPage
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		orders, total, err := database.ListUserOrders(ctx, app.orderCollection, userID, page, perPage)
+		if err != nil {
+			fail(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"orders": dto.NewOrders(orders),
+			"page": page,
+			"per_page": perPage,
+			"total": total,
+		})
+	}
+}
+
+func (app *Application) GetOrder() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := currentUserID(c)
+		if !ok {
+			return
+		}
+
+		orderID, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			fail(c, errInvalidOrderID)
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		order, err := database.GetUserOrder(ctx, app.orderCollection, userID, orderID)
+		if err != nil {
+			fail(c, orderError(err))
+			return
+		}
+
+		c.JSON(http.StatusOK, dto.NewOrder(order))
+	}
+}
+
+type orderStatusRequest struct {
+	Status models.OrderStatus `json:"status" validate:"required"`
+	Note string `json:"note" validate:"max=500"`
+}
+
+// orderError hides whether a user exists behind the order not being
+// found.
+func orderError(err error) error {
+	if errors.Is(err, database.ErrUserIdIsNotValid) {
+		return database.ErrCantFindOrder
+	}
+	return err
+}
+
+func (app *Application) CancelOrder() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := currentUserID(c)
+		if !ok {
+			return
+		}
+
+		orderID, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			fail(c, errInvalidOrderID)
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		order, err := database.TransitionUserOrder(ctx, app.orderCollection, app.productCollection, userID, orderID, models.OrderCancelled, "cancelled by customer")
+		if err != nil {
+			fail(c, orderError(err))
+			return
+		}
+
+		c.JSON(http.StatusOK, dto.NewOrder(order))
+	}
+}
+
+func (app *Application) UpdateOrderStatus() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		orderID, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			fail(c, errInvalidOrderID)
+			return
+		}
+
+		var request orderStatusRequest
+		if !bindRequest(c, &request) {
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		order, err := database.TransitionOrder(ctx, app.orderCollection, app.productCollection, orderID, request.Status, c.GetString("uid"), request.Note)
+		if err != nil {
+			fail(c, orderError(err))
+			return
+		}
+
+		c.JSON(http.StatusOK, dto.NewOrder(order))
+	}
+}
@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/GadirB/ecommerce-go/database"
+	"github.com/GadirB/ecommerce-go/mail"
+	"github.com/GadirB/ecommerce-go/models"
+	generate "github.com/GadirB/ecommerce-go/tokens"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var passwordResetCollection *mongo.Collection = database.PasswordResetData(database.Client, "PasswordResets")
+
+type forgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type resetPasswordRequest struct {
+	Token string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,min=6"`
+}
+
+// passwordResetURL is the page of the frontend that takes the reset token
+// from its "token" query parameter.
+func passwordResetURL(token string) string {
+	base := os.Getenv("PASSWORD_RESET_URL")
+	if base == "" {
+		base = "http://localhost:3000/reset-password"
+	}
+	return base + "?token=" + url.QueryEscape(token)
+}
+
+// ForgotPassword mails a reset link to the user with the given email. It
+// answers the same way whether or not the account exists, and the reset is
+// created and mailed in the background so the response time doesn't tell
+// either.
+func ForgotPassword() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request forgotPasswordRequest
+		if !bindRequest(c, &request) {
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var user models.User
+		err := userCollection.FindOne(ctx, bson.M{"email": request.Email}).Decode(&user)
+		if err != nil && err != mongo.ErrNoDocuments {
+			fail(c, err)
+			return
+		}
+
+		if err == nil {
+			go sendPasswordReset(user.User_ID, request.Email)
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"message": "if an account exists for this email, a reset link has been sent to it"})
+	}
+}
+
+func sendPasswordReset(userID string, email string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	token, err := database.CreatePasswordReset(ctx, passwordResetCollection, userID)
+	if err != nil {
+		return
+	}
+
+	err = mail.Default.Send(ctx, mail.Message{
+		To: email,
+		Subject: "Reset your password",
+		Body: "Someone asked to reset the password of your account. If it was you, open the link below within " +
+			database.PasswordResetTTL.String() + " to choose a new one:\n\n" + passwordResetURL(token) +
+			"\n\nIf it wasn't you, you can ignore this email.\n",
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// ResetPassword sets a new password with a token from ForgotPassword and
+// logs the user out of every session.
+func ResetPassword() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request resetPasswordRequest
+		if !bindRequest(c, &request) {
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		userID, err := database.ConsumePasswordReset(ctx, passwordResetCollection, request.Token)
+		if err != nil {
+			fail(c, err)
+			return
+		}
+
+		if err = database.SetUserPassword(ctx, userCollection, userID, HashPassword(request.Password)); err != nil {
+			fail(c, err)
+			return
+		}
+
+		if err = generate.RevokeAllUserTokens(ctx, userID); err != nil {
+			fail(c, errCantRevokeSessions)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "password changed, please log in again"})
+	}
+}
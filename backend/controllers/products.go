@@ -0,0 +1,279 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/GadirB/ecommerce-go/database"
+	"github.com/GadirB/ecommerce-go/dto"
+	"github.com/GadirB/ecommerce-go/models"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultProductsPerPage = 20
+	maxProductsPerPage = 100
+)
+
+// productPatchRequest is the body of a partial product update; only the
+// fields that are present are changed.
+type productPatchRequest struct {
+	Product_Name *string `json:"product_name" validate:"omitempty,min=2,max=200"`
+	Price *uint64 `json:"price"`
+	Rating *uint8 `json:"rating" validate:"omitempty,max=5"`
+	Image *string `json:"image" validate:"omitempty,max=2048"`
+	Stock *int `json:"stock" validate:"omitempty,min=0"`
+}
+
+func (p productPatchRequest) fields() bson.D {
+	fields := bson.D{}
+	if p.Product_Name != nil {
+		fields = append(fields, bson.E{Key: "product_name", Value: *p.Product_Name})
+	}
+	if p.Price != nil {
+		fields = append(fields, bson.E{Key: "price", Value: *p.Price})
+	}
+	if p.Rating != nil {
+		fields = append(fields, bson.E{Key: "rating", Value: *p.Rating})
+	}
+	if p.Image != nil {
+		fields = append(fields, bson.E{Key: "image", Value: *p.Image})
+	}
+	if p.Stock != nil {
+		fields = append(fields, bson.E{Key: "stock", Value: *p.Stock})
+	}
+	return fields
+}
+
+func productIDParam(c *gin.Context) (primitive.ObjectID, bool) {
+	productID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		fail(c, errInvalidProductID)
+		return productID, false
+	}
+	return productID, true
+}
+
+func (app *Application) CreateProduct() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var product models.Product
+		if !bindRequest(c, &product) {
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := database.CreateProduct(ctx, app.productCollection, &product); err != nil {
+			fail(c, err)
+			return
+		}
+
+		c.JSON(http.StatusCreated, dto.NewAdminProduct(product))
+	}
+}
+
+func (app *Application) GetProductAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		productID, ok := productIDParam(c)
+		if !ok {
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		product, err := database.GetProduct(ctx, app.productCollection, productID)
+		if err != nil {
+			fail(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, dto.NewAdminProduct(product))
+	}
+}
+
+// ReplaceProduct is the full update: every editable field is taken from the
+// body and validated exactly as on create.
+func (app *Application) ReplaceProduct() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		productID, ok := productIDParam(c)
+		if !ok {
+			return
+		}
+
+		var product models.Product
+		if !bindRequest(c, &product) {
+			return
+		}
+
+		fields := bson.D{
+			{Key: "product_name", Value: product.Product_Name},
+			{Key: "price", Value: product.Price},
+			{Key: "rating", Value: product.Rating},
+			{Key: "image", Value: product.Image},
+			{Key: "stock", Value: product.Stock},
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		updated, err := database.UpdateProduct(ctx, app.productCollection, productID, fields)
+		if err != nil {
+			fail(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, dto.NewAdminProduct(updated))
+	}
+}
+
+func (app *Application) PatchProduct() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		productID, ok := productIDParam(c)
+		if !ok {
+			return
+		}
+
+		var patch productPatchRequest
+		if !bindRequest(c, &patch) {
+			return
+		}
+
+		fields := patch.fields()
+		if len(fields) == 0 {
+			fail(c, database.InvalidInput("no fields to update"))
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		updated, err := database.UpdateProduct(ctx, app.productCollection, productID, fields)
+		if err != nil {
+			fail(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, dto.NewAdminProduct(updated))
+	}
+}
+
+func (app *Application) DeleteProduct() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		productID, ok := productIDParam(c)
+		if !ok {
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := database.SoftDeleteProduct(ctx, app.productCollection, productID); err != nil {
+			fail(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "product deleted"})
+	}
+}
+
+func (app *Application) RestoreProduct() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		productID, ok := productIDParam(c)
+		if !ok {
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := database.RestoreProduct(ctx, app.productCollection, productID); err != nil {
+			fail(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "product restored"})
+	}
+}
+
+// ListProductsAdmin lists products for staff, including deleted ones on
+// request. Supported query parameters: name, min_price, max_price,
+// min_rating, deleted (exclude, only or include), page and per_page.
+func (app *Application) ListProductsAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var filter database.ProductFilter
+		filter.Name = c.Query("name")
+
+		if value := c.Query("min_price"); value != "" {
+			price, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				fail(c, database.InvalidInput("min_price must be a non-negative number"))
+				return
+			}
+			filter.Min_Price = &price
+		}
+
+		if value := c.Query("max_price"); value != "" {
+			price, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				fail(c, database.InvalidInput("max_price must be a non-negative number"))
+				return
+			}
+			filter.Max_Price = &price
+		}
+
+		if value := c.Query("min_rating"); value != "" {
+			rating, err := strconv.ParseUint(value, 10, 8)
+			if err != nil || rating > 5 {
+				fail(c, database.InvalidInput("min_rating must be between 0 and 5"))
+				return
+			}
+			minRating := uint8(rating)
+			filter.Min_Rating = &minRating
+		}
+
+		filter.Deleted = c.DefaultQuery("deleted", database.DeletedExclude)
+		switch filter.Deleted {
+		case database.DeletedExclude, database.DeletedOnly, database.DeletedInclude:
+		default:
+			fail(c, database.InvalidInput("deleted must be one of exclude, only or include"))
+			return
+		}
+
+		page, err := strconv.ParseInt(c.DefaultQuery("page", "1"), 10, 64)
+		if err != nil || page < 1 {
+			fail(c, database.InvalidInput("page must be a positive number"))
+			return
+		}
+
+		perPage, err := strconv.ParseInt(c.DefaultQuery("per_page", strconv.Itoa(defaultProductsPerPage)), 10, 64)
+		if err != nil || perPage < 1 {
+			fail(c, database.InvalidInput("per_page must be a positive number"))
+			return
+		}
+		if perPage > maxProductsPerPage {
+			perPage = maxProductsPerPage
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		products, total, err := database.ListProducts(ctx, app.productCollection, filter, page, perPage)
+		if err != nil {
+			fail(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"products": dto.NewAdminProducts(products),
+			"page": page,
+			"per_page": perPage,
+			"total": total,
+		})
+	}
+}
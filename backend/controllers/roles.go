@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/GadirB/ecommerce-go/database"
+	"github.com/GadirB/ecommerce-go/models"
+	generate "github.com/GadirB/ecommerce-go/tokens"
+	"github.com/gin-gonic/gin"
+)
+
+var errRevokeOwnAdmin = database.NewError(database.KindConflict, "cant_revoke_own_admin", "admins can't revoke their own admin role")
+
+func (app *Application) GrantRole() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := models.Role(c.Param("role"))
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		user, err := database.GrantRole(ctx, app.userCollection, c.Param("id"), role)
+		if err != nil {
+			fail(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"user_id": user.User_ID, "roles": user.Roles})
+	}
+}
+
+// RevokeRole takes a role from a user and ends their sessions, since their
+// tokens still carry the role.
+func (app *Application) RevokeRole() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := models.Role(c.Param("role"))
+		userID := c.Param("id")
+
+		if role == models.RoleAdmin && userID == c.GetString("uid") {
+			fail(c, errRevokeOwnAdmin)
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		user, err := database.RevokeRole(ctx, app.userCollection, userID, role)
+		if err != nil {
+			fail(c, err)
+			return
+		}
+
+		if err = generate.RevokeAllUserTokens(ctx, userID); err != nil {
+			fail(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"user_id": user.User_ID, "roles": user.Roles})
+	}
+}
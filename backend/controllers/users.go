@@ -0,0 +1,306 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/GadirB/ecommerce-go/database"
+	"github.com/GadirB/ecommerce-go/dto"
+	"github.com/GadirB/ecommerce-go/mail"
+	"github.com/GadirB/ecommerce-go/models"
+	generate "github.com/GadirB/ecommerce-go/tokens"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// profilePatchRequest is the body of PATCH /users/me; only the fields that
+// are present are changed.
+type profilePatchRequest struct {
+	First_Name *string `json:"first_name" validate:"omitnil,min=2,max=30"`
+	Last_Name *string `json:"last_name" validate:"omitnil,min=2,max=30"`
+	Phone *string `json:"phone" validate:"omitnil,min=1"`
+}
+
+func (p profilePatchRequest) fields() bson.D {
+	fields := bson.D{}
+	if p.First_Name != nil {
+		fields = append(fields, bson.E{Key: "first_name", Value: *p.First_Name})
+	}
+	if p.Last_Name != nil {
+		fields = append(fields, bson.E{Key: "last_name", Value: *p.Last_Name})
+	}
+	if p.Phone != nil {
+		fields = append(fields, bson.E{Key: "phone", Value: *p.Phone})
+	}
+	return fields
+}
+
+type changePasswordRequest struct {
+	Current_Password string `json:"current_password" validate:"required"`
+	New_Password string `json:"new_password" validate:"required,min=6"`
+}
+
+type changeEmailRequest struct {
+	Password string `json:"password" validate:"required"`
+	Email string `json:"email" validate:"required,email"`
+}
+
+type deleteAccountRequest struct {
+	Password string `json:"password" validate:"required"`
+}
+
+// bindRequest binds and validates a JSON body, failing the request if it
+// isn't acceptable.
+func bindRequest(c *gin.Context, request interface{}) bool {
+	if err := c.ShouldBindJSON(request); err != nil {
+		fail(c, errInvalidBody)
+		return false
+	}
+	if validationErr := Validate.Struct(request); validationErr != nil {
+		fail(c, validationErr)
+		return false
+	}
+	return true
+}
+
+// checkPassword loads the user and checks password against theirs, failing
+// the request if it doesn't match. Wrong guesses count towards the same
+// lockout as failed logins, so a stolen token can't be used to brute force
+// the password. A right one doesn't reset the count, as a second factor may
+// still be checked after it; only a completed login does.
+func (app *Application) checkPassword(c *gin.Context, ctx context.Context, userID string, password string) (models.User, bool) {
+	user, err := database.GetUser(ctx, app.userCollection, userID)
+	if err != nil {
+		fail(c, err)
+		return user, false
+	}
+
+	email := dto.Deref(user.Email)
+	retryAfter, err := database.CheckLogin(ctx, loginThrottleCollection, email, c.ClientIP())
+	if errors.Is(err, database.ErrLoginLocked) {
+		c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		fail(c, err)
+		return user, false
+	}
+	if err != nil {
+		fail(c, err)
+		return user, false
+	}
+
+	if valid, _ := VerifyPassword(password, dto.Deref(user.Password)); !valid {
+		if recordErr := database.RecordLoginFailure(ctx, loginThrottleCollection, email, c.ClientIP()); recordErr != nil {
+			log.Println(recordErr)
+		}
+		fail(c, errWrongPassword)
+		return user, false
+	}
+	return user, true
+}
+
+func (app *Application) GetProfile() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := currentUserID(c)
+		if !ok {
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		user, err := database.GetUser(ctx, app.userCollection, userID)
+		if err != nil {
+			fail(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, dto.NewUser(user, database.EffectiveRoles(user)))
+	}
+}
+
+func (app *Application) UpdateProfile() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := ownUserID(c)
+		if !ok {
+			return
+		}
+
+		var patch profilePatchRequest
+		if !bindRequest(c, &patch) {
+			return
+		}
+
+		fields := patch.fields()
+		if len(fields) == 0 {
+			fail(c, database.InvalidInput("no fields to update"))
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		user, err := database.UpdateProfile(ctx, app.userCollection, userID, fields)
+		if err != nil {
+			fail(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, dto.NewUser(user, database.EffectiveRoles(user)))
+	}
+}
+
+// ChangePassword sets a new password and ends every other session. The
+// caller gets a fresh token pair to stay logged in with.
+func (app *Application) ChangePassword() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := ownUserID(c)
+		if !ok {
+			return
+		}
+
+		var request changePasswordRequest
+		if !bindRequest(c, &request) {
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		user, ok := app.checkPassword(c, ctx, userID, request.Current_Password)
+		if !ok {
+			return
+		}
+
+		if err := database.SetUserPassword(ctx, app.userCollection, userID, HashPassword(request.New_Password)); err != nil {
+			fail(c, err)
+			return
+		}
+
+		if err := generate.RevokeAllUserTokens(ctx, userID); err != nil {
+			fail(c, errCantRevokeSessions)
+			return
+		}
+
+		var authMethods []string
+		if value, exists := c.Get("claims"); exists {
+			if claims, ok := value.(*generate.SignedDetails); ok {
+				authMethods = claims.Auth_Methods
+			}
+		}
+
+		token, refreshToken, err := generate.TokenGenerator(*user.Email, *user.First_Name, *user.Last_Name, user.User_ID, database.EffectiveRoles(user), authMethods)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"message": "password changed, please log in again"})
+			return
+		}
+		generate.UpdateAllTokens(token, refreshToken, user.User_ID)
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "password changed",
+			"token": token,
+			"refresh_token": refreshToken,
+		})
+	}
+}
+
+// ChangeEmail starts moving the account to a new address. The account keeps
+// its current address until the link mailed to the new one is opened, and
+// the old one is told about the request.
+func (app *Application) ChangeEmail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := ownUserID(c)
+		if !ok {
+			return
+		}
+
+		var request changeEmailRequest
+		if !bindRequest(c, &request) {
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		user, ok := app.checkPassword(c, ctx, userID, request.Password)
+		if !ok {
+			return
+		}
+
+		oldEmail := dto.Deref(user.Email)
+		if request.Email == oldEmail {
+			fail(c, database.InvalidInput("this is already your email"))
+			return
+		}
+
+		// The verification is only honoured while the account has the address
+		// it was sent to as its pending email, so creating it first is safe
+		// and rate limits changes.
+		token, err := database.CreateEmailVerification(ctx, verificationCollection, userID, request.Email)
+		if err != nil {
+			fail(c, err)
+			return
+		}
+
+		if err = database.RequestEmailChange(ctx, app.userCollection, userID, request.Email); err != nil {
+			fail(c, err)
+			return
+		}
+
+		go mailEmailVerification(request.Email, token)
+		go notifyEmailChangeRequested(oldEmail, request.Email)
+
+		c.JSON(http.StatusAccepted, gin.H{"message": "check the inbox of your new email to confirm the change"})
+	}
+}
+
+func notifyEmailChangeRequested(oldEmail string, newEmail string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err := mail.Default.Send(ctx, mail.Message{
+		To: oldEmail,
+		Subject: "Your email address is being changed",
+		Body: "A change of your account's email address to " + newEmail +
+			" was requested. It takes effect once the new address is confirmed." +
+			" If you didn't do this, reset your password and contact support.\n",
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// DeleteAccount deletes the user's account and ends all their sessions.
+func (app *Application) DeleteAccount() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := ownUserID(c)
+		if !ok {
+			return
+		}
+
+		var request deleteAccountRequest
+		if !bindRequest(c, &request) {
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if _, ok := app.checkPassword(c, ctx, userID, request.Password); !ok {
+			return
+		}
+
+		if err := database.DeleteUser(ctx, app.userCollection, app.productCollection, app.reservationCollection, userID); err != nil {
+			fail(c, err)
+			return
+		}
+
+		if err := generate.RevokeAllUserTokens(ctx, userID); err != nil {
+			log.Println(err)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "account deleted"})
+	}
+}
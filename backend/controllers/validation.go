@@ -0,0 +1,123 @@
+package controllers
+
+import (
+	"log"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/GadirB/ecommerce-go/models"
+	"github.com/go-playground/validator/v10"
+)
+
+// newValidator returns a validator that names fields by their JSON name, so
+// validation errors refer to fields the way clients send them, and knows
+// the rules for addresses.
+func newValidator() *validator.Validate {
+	validate := validator.New()
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+
+	if err := validate.RegisterValidation("phone", validatePhone); err != nil {
+		log.Panic(err)
+	}
+	validate.RegisterStructValidation(validateAddress, models.Address{})
+	return validate
+}
+
+var phonePunctuation = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "")
+
+var phonePattern = regexp.MustCompile(`^\+?[0-9]{7,15}$`)
+
+// validatePhone accepts phone numbers of 7 to 15 digits with an optional
+// leading + and the usual spaces, dashes, dots and parentheses.
+func validatePhone(fl validator.FieldLevel) bool {
+	return phonePattern.MatchString(phonePunctuation.Replace(fl.Field().String()))
+}
+
+// countryRules are the address rules of one country.
+type countryRules struct {
+	// Postal_Code is the format of the country's postal codes, or nil if
+	// it has none.
+	Postal_Code *regexp.Regexp
+	Region_Required bool
+}
+
+// addressRules holds the countries with known address rules. Addresses in
+// other countries only need the fields every address needs.
+var addressRules = map[string]countryRules{
+	"AE": {},
+	"AU": {Postal_Code: regexp.MustCompile(`^\d{4}$`), Region_Required: true},
+	"AZ": {Postal_Code: regexp.MustCompile(`^(AZ ?)?\d{4}$`)},
+	"BR": {Postal_Code: regexp.MustCompile(`^\d{5}-?\d{3}$`), Region_Required: true},
+	"CA": {Postal_Code: regexp.MustCompile(`^[A-Z]\d[A-Z] ?\d[A-Z]\d$`), Region_Required: true},
+	"CN": {Postal_Code: regexp.MustCompile(`^\d{6}$`), Region_Required: true},
+	"DE": {Postal_Code: regexp.MustCompile(`^\d{5}$`)},
+	"ES": {Postal_Code: regexp.MustCompile(`^\d{5}$`)},
+	"FR": {Postal_Code: regexp.MustCompile(`^\d{5}$`)},
+	"GB": {Postal_Code: regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`)},
+	"HK": {},
+	"IN": {Postal_Code: regexp.MustCompile(`^\d{6}$`), Region_Required: true},
+	"IT": {Postal_Code: regexp.MustCompile(`^\d{5}$`)},
+	"JP": {Postal_Code: regexp.MustCompile(`^\d{3}-?\d{4}$`), Region_Required: true},
+	"MX": {Postal_Code: regexp.MustCompile(`^\d{5}$`), Region_Required: true},
+	"NL": {Postal_Code: regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`)},
+	"PL": {Postal_Code: regexp.MustCompile(`^\d{2}-\d{3}$`)},
+	"QA": {},
+	"RU": {Postal_Code: regexp.MustCompile(`^\d{6}$`)},
+	"TR": {Postal_Code: regexp.MustCompile(`^\d{5}$`)},
+	"US": {Postal_Code: regexp.MustCompile(`^\d{5}(-\d{4})?$`), Region_Required: true},
+}
+
+// validateAddress applies the rules of the address's country: the postal
+// code must be present and well formed where the country has postal codes,
+// and some countries need a region (state, province or prefecture).
+func validateAddress(sl validator.StructLevel) {
+	address := sl.Current().Interface().(models.Address)
+	if address.Country == nil {
+		return
+	}
+
+	country := *address.Country
+	rules, known := addressRules[country]
+	if !known {
+		return
+	}
+
+	postalCode := ""
+	if address.Postal_Code != nil {
+		postalCode = *address.Postal_Code
+	}
+	switch {
+	case rules.Postal_Code != nil && postalCode == "":
+		sl.ReportError(address.Postal_Code, "postal_code", "Postal_Code", "required_in_country", country)
+	case rules.Postal_Code != nil && !rules.Postal_Code.MatchString(postalCode):
+		sl.ReportError(address.Postal_Code, "postal_code", "Postal_Code", "postal_code", country)
+	}
+
+	if rules.Region_Required && (address.Region == nil || *address.Region == "") {
+		sl.ReportError(address.Region, "region", "Region", "required_in_country", country)
+	}
+}
+
+// normalizeAddress upper-cases the country and postal code and trims the
+// fields the rules look at, so " us " and "us" are the same country.
+func normalizeAddress(address *models.Address) {
+	if address.Country != nil {
+		country := strings.ToUpper(strings.TrimSpace(*address.Country))
+		address.Country = &country
+	}
+	if address.Postal_Code != nil {
+		postalCode := strings.ToUpper(strings.TrimSpace(*address.Postal_Code))
+		address.Postal_Code = &postalCode
+	}
+	if address.Region != nil {
+		region := strings.TrimSpace(*address.Region)
+		address.Region = &region
+	}
+}
@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/GadirB/ecommerce-go/database"
+	"github.com/GadirB/ecommerce-go/mail"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var verificationCollection *mongo.Collection = database.VerificationData(database.Client, "EmailVerifications")
+
+// emailVerificationURL is where the verification link points, by default
+// straight at GET /users/verify.
+func emailVerificationURL(token string) string {
+	base := os.Getenv("EMAIL_VERIFICATION_URL")
+	if base == "" {
+		base = "http://localhost:8000/users/verify"
+	}
+	return base + "?token=" + url.QueryEscape(token)
+}
+
+func mailEmailVerification(email string, token string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err := mail.Default.Send(ctx, mail.Message{
+		To: email,
+		Subject: "Verify your email address",
+		Body: "Please confirm this is your email address by opening the link below within " +
+			database.EmailVerificationTTL.String() + ":\n\n" + emailVerificationURL(token) +
+			"\n\nIf you didn't create an account, you can ignore this email.\n",
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// sendEmailVerification creates and mails a verification for a new user.
+func sendEmailVerification(userID string, email string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	token, err := database.CreateEmailVerification(ctx, verificationCollection, userID, email)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	mailEmailVerification(email, token)
+}
+
+// VerifyEmail confirms the email address with the token from the link in
+// the verification email.
+func VerifyEmail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.Query("token")
+		if token == "" {
+			fail(c, database.InvalidInput("token is required"))
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		err := database.VerifyEmail(ctx, verificationCollection, userCollection, token)
+		if err != nil {
+			fail(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "email verified"})
+	}
+}
+
+// ResendVerification mails a new verification link to the current user, or
+// to the new address of their pending email change.
+func ResendVerification() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := currentUserID(c)
+		if !ok {
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		user, err := database.GetUser(ctx, userCollection, userID)
+		if err != nil {
+			fail(c, err)
+			return
+		}
+
+		// A pending email change is confirmed with the same link.
+		email := *user.Email
+		if user.Pending_Email != nil {
+			email = *user.Pending_Email
+		} else if user.Email_Verified {
+			fail(c, database.ErrEmailAlreadyVerified)
+			return
+		}
+
+		token, err := database.CreateEmailVerification(ctx, verificationCollection, userID, email)
+		if err != nil {
+			fail(c, err)
+			return
+		}
+
+		go mailEmailVerification(email, token)
+
+		c.JSON(http.StatusAccepted, gin.H{"message": "verification email sent"})
+	}
+}
@@ -0,0 +1,321 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/GadirB/ecommerce-go/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrAddressNotFound = NewError(KindNotFound, "address_not_found", "address not found")
+	ErrTooManyAddresses = NewError(KindConflict, "address_limit_reached", "the address book is full")
+	ErrCantUpdateAddress = NewError(KindInternal, "cant_update_address", "can't update address")
+	ErrShippingAddressRequired = NewError(KindInvalid, "shipping_address_required", "choose a shipping address or set a default one")
+)
+
+// MaxAddresses is how many addresses one user can keep. main overrides it
+// from MAX_ADDRESSES.
+var MaxAddresses = 10
+
+// Default flags of an address. At most one address of a user has each.
+const (
+	defaultShippingField = "default_shipping"
+	defaultBillingField = "default_billing"
+)
+
+func findAddress(addresses []models.Address, addressID primitive.ObjectID) (models.Address, bool) {
+	for _, address := range addresses {
+		if address.Address_ID == addressID {
+			return address, true
+		}
+	}
+	return models.Address{}, false
+}
+
+// AddressChoice names the addresses of the user's book an order goes to.
+// A nil id means the default address of that kind; billing falls back to
+// the shipping address when there is no default billing address either.
+type AddressChoice struct {
+	Shipping_Address_ID *primitive.ObjectID
+	Billing_Address_ID *primitive.ObjectID
+}
+
+// snapshotAddress copies an address for an order, so editing or deleting it
+// in the address book later doesn't change where the order went.
+func snapshotAddress(address models.Address) *models.Address {
+	address.Default_Shipping = false
+	address.Default_Billing = false
+	return &address
+}
+
+// orderAddresses resolves choice against the user's address book and
+// returns snapshots of the shipping and billing addresses.
+func orderAddresses(user models.User, choice AddressChoice) (*models.Address, *models.Address, error) {
+	var shipping, billing models.Address
+	var found bool
+
+	if choice.Shipping_Address_ID != nil {
+		if shipping, found = findAddress(user.Address_Details, *choice.Shipping_Address_ID); !found {
+			return nil, nil, ErrAddressNotFound
+		}
+	} else {
+		for _, address := range user.Address_Details {
+			if address.Default_Shipping {
+				shipping, found = address, true
+			}
+		}
+		if !found {
+			return nil, nil, ErrShippingAddressRequired
+		}
+	}
+
+	billing = shipping
+	if choice.Billing_Address_ID != nil {
+		if billing, found = findAddress(user.Address_Details, *choice.Billing_Address_ID); !found {
+			return nil, nil, ErrAddressNotFound
+		}
+	} else {
+		for _, address := range user.Address_Details {
+			if address.Default_Billing {
+				billing = address
+			}
+		}
+	}
+
+	return snapshotAddress(shipping), snapshotAddress(billing), nil
+}
+
+// MigrateAddressPostalCodes moves the pin_code of addresses written before
+// addresses had a country to postal_code.
+func MigrateAddressPostalCodes(ctx context.Context, userCollection *mongo.Collection) error {
+	legacy := bson.D{primitive.E{Key: "pin_code", Value: bson.D{primitive.E{Key: "$exists", Value: true}}}}
+	filter := bson.D{primitive.E{Key: "address", Value: bson.D{primitive.E{Key: "$elemMatch", Value: legacy}}}}
+
+	// For each address: add postal_code from pin_code unless it has one, then
+	// drop pin_code.
+	renamed := bson.D{primitive.E{Key: "$arrayToObject", Value: bson.D{primitive.E{Key: "$filter", Value: bson.D{
+		primitive.E{Key: "input", Value: bson.D{primitive.E{Key: "$objectToArray", Value: bson.D{primitive.E{Key: "$mergeObjects", Value: bson.A{
+			bson.D{primitive.E{Key: "postal_code", Value: "$$address.pin_code"}},
+			"$$address",
+		}}}}}},
+		{Key: "cond", Value: bson.D{primitive.E{Key: "$ne", Value: bson.A{"$$this.k", "pin_code"}}}},
+	}}}}}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.D{primitive.E{Key: "address", Value: bson.D{primitive.E{Key: "$map", Value: bson.D{
+			primitive.E{Key: "input", Value: "$address"},
+			{Key: "as", Value: "address"},
+			{Key: "in", Value: renamed},
+		}}}}}}},
+	}
+
+	_, err := userCollection.UpdateMany(ctx, filter, update)
+	return err
+}
+
+// MigrateAddressDefaults makes the first address the default for shipping
+// and billing of users whose addresses were written before default flags
+// existed, so checkout without an address id keeps working for them.
+func MigrateAddressDefaults(ctx context.Context, userCollection *mongo.Collection) error {
+	for _, field := range []string{defaultShippingField, defaultBillingField} {
+		filter := bson.D{
+			primitive.E{Key: "address.0", Value: bson.D{primitive.E{Key: "$exists", Value: true}}},
+			{Key: "address." + field, Value: bson.D{primitive.E{Key: "$ne", Value: true}}},
+		}
+		update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "address.0." + field, Value: true}}}}
+		result, err := userCollection.UpdateMany(ctx, filter, update)
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount > 0 {
+			log.Printf("set %s on the first address of %d users", field, result.ModifiedCount)
+		}
+	}
+	return nil
+}
+
+// ListAddresses returns the user's address book.
+func ListAddresses(ctx context.Context, userCollection *mongo.Collection, userID string) ([]models.Address, error) {
+	user, err := GetUser(ctx, userCollection, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.Address_Details == nil {
+		return []models.Address{}, nil
+	}
+	return user.Address_Details, nil
+}
+
+func GetAddress(ctx context.Context, userCollection *mongo.Collection, userID string, addressID primitive.ObjectID) (models.Address, error) {
+	user, err := GetUser(ctx, userCollection, userID)
+	if err != nil {
+		return models.Address{}, err
+	}
+	address, found := findAddress(user.Address_Details, addressID)
+	if !found {
+		return address, ErrAddressNotFound
+	}
+	return address, nil
+}
+
+// clearDefault takes a default flag off every address of the user.
+func clearDefault(ctx context.Context, userCollection *mongo.Collection, id primitive.ObjectID, field string) error {
+	filter := bson.D{primitive.E{Key: "_id", Value: id}, {Key: "address." + field, Value: true}}
+	update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "address.$[]." + field, Value: false}}}}
+	_, err := userCollection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// AddAddress adds an address to the user's book and returns it with its new
+// id. The first address becomes the default for shipping and billing;
+// otherwise an address flagged as default takes the flag from the one that
+// had it.
+func AddAddress(ctx context.Context, userCollection *mongo.Collection, userID string, address models.Address) (models.Address, error) {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return address, ErrUserIdIsNotValid
+	}
+
+	address.Address_ID = primitive.NewObjectID()
+
+	_, err = runInTransaction(ctx, userCollection, func(sc mongo.SessionContext) (interface{}, error) {
+		var user models.User
+		if err := userCollection.FindOne(sc, bson.D{primitive.E{Key: "_id", Value: id}}).Decode(&user); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return nil, ErrUserIdIsNotValid
+			}
+			return nil, err
+		}
+		if len(user.Address_Details) >= MaxAddresses {
+			return nil, ErrTooManyAddresses
+		}
+
+		if len(user.Address_Details) == 0 {
+			address.Default_Shipping = true
+			address.Default_Billing = true
+		}
+		if address.Default_Shipping {
+			if err := clearDefault(sc, userCollection, id, defaultShippingField); err != nil {
+				return nil, err
+			}
+		}
+		if address.Default_Billing {
+			if err := clearDefault(sc, userCollection, id, defaultBillingField); err != nil {
+				return nil, err
+			}
+		}
+
+		update := bson.D{{Key: "$push", Value: bson.D{primitive.E{Key: "address", Value: address}}}}
+		_, err := userCollection.UpdateOne(sc, bson.D{primitive.E{Key: "_id", Value: id}}, update)
+		return nil, err
+	})
+	if errors.Is(err, ErrUserIdIsNotValid) || errors.Is(err, ErrTooManyAddresses) {
+		return address, err
+	}
+	if err != nil {
+		log.Println(err)
+		return address, ErrCantUpdateAddress
+	}
+	return address, nil
+}
+
+// UpdateAddress sets the given fields of one address and returns it. Keys
+// are the address's bson field names. Setting a default flag moves it from
+// the address that had it.
+func UpdateAddress(ctx context.Context, userCollection *mongo.Collection, userID string, addressID primitive.ObjectID, fields bson.D) (models.Address, error) {
+	var address models.Address
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return address, ErrUserIdIsNotValid
+	}
+
+	filter := bson.D{primitive.E{Key: "_id", Value: id}, {Key: "address._id", Value: addressID}}
+
+	set := bson.D{}
+	for _, field := range fields {
+		set = append(set, bson.E{Key: "address.$." + field.Key, Value: field.Value})
+	}
+
+	_, err = runInTransaction(ctx, userCollection, func(sc mongo.SessionContext) (interface{}, error) {
+		count, err := userCollection.CountDocuments(sc, filter)
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			return nil, ErrAddressNotFound
+		}
+
+		for _, field := range fields {
+			if isDefault, ok := field.Value.(bool); ok && isDefault && (field.Key == defaultShippingField || field.Key == defaultBillingField) {
+				if err := clearDefault(sc, userCollection, id, field.Key); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		_, err = userCollection.UpdateOne(sc, filter, bson.D{{Key: "$set", Value: set}})
+		return nil, err
+	})
+	if errors.Is(err, ErrAddressNotFound) {
+		return address, err
+	}
+	if err != nil {
+		log.Println(err)
+		return address, ErrCantUpdateAddress
+	}
+
+	return GetAddress(ctx, userCollection, userID, addressID)
+}
+
+// DeleteAddress removes one address. If it was a default, the flag moves to
+// the oldest remaining address.
+func DeleteAddress(ctx context.Context, userCollection *mongo.Collection, userID string, addressID primitive.ObjectID) error {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return ErrUserIdIsNotValid
+	}
+
+	_, err = runInTransaction(ctx, userCollection, func(sc mongo.SessionContext) (interface{}, error) {
+		var user models.User
+		if err := userCollection.FindOne(sc, bson.D{primitive.E{Key: "_id", Value: id}}).Decode(&user); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return nil, ErrUserIdIsNotValid
+			}
+			return nil, err
+		}
+		deleted, found := findAddress(user.Address_Details, addressID)
+		if !found {
+			return nil, ErrAddressNotFound
+		}
+
+		update := bson.D{{Key: "$pull", Value: bson.D{primitive.E{Key: "address", Value: bson.D{primitive.E{Key: "_id", Value: addressID}}}}}}
+		if _, err := userCollection.UpdateOne(sc, bson.D{primitive.E{Key: "_id", Value: id}}, update); err != nil {
+			return nil, err
+		}
+
+		promote := bson.D{}
+		if deleted.Default_Shipping {
+			promote = append(promote, bson.E{Key: "address.0." + defaultShippingField, Value: true})
+		}
+		if deleted.Default_Billing {
+			promote = append(promote, bson.E{Key: "address.0." + defaultBillingField, Value: true})
+		}
+		if len(promote) == 0 || len(user.Address_Details) == 1 {
+			return nil, nil
+		}
+		_, err := userCollection.UpdateOne(sc, bson.D{primitive.E{Key: "_id", Value: id}}, bson.D{{Key: "$set", Value: promote}})
+		return nil, err
+	})
+	if errors.Is(err, ErrUserIdIsNotValid) || errors.Is(err, ErrAddressNotFound) {
+		return err
+	}
+	if err != nil {
+		log.Println(err)
+		return ErrCantUpdateAddress
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package database
+
+import (
+	"context"
+	"log"
+
+	"github.com/GadirB/ecommerce-go/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var ErrCantWriteAudit = NewError(KindInternal, "cant_write_audit", "can't write audit entry")
+
+func AuditData(client *mongo.Client, collectionName string) *mongo.Collection{
+	var auditCollection *mongo.Collection = client.Database("Ecommerce").Collection(collectionName)
+	return auditCollection
+}
+
+// EnsureAuditIndexes creates the indexes used to review audit entries by
+// actor and by the user acted upon.
+func EnsureAuditIndexes(ctx context.Context, auditCollection *mongo.Collection) error {
+	_, err := auditCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "actor_id", Value: 1}, {Key: "at", Value: -1}}},
+		{Keys: bson.D{{Key: "target_id", Value: 1}, {Key: "at", Value: -1}}},
+	})
+	return err
+}
+
+func RecordAudit(ctx context.Context, auditCollection *mongo.Collection, entry models.AuditEntry) error {
+	if _, err := auditCollection.InsertOne(ctx, entry); err != nil {
+		log.Println(err)
+		return ErrCantWriteAudit
+	}
+	return nil
+}
@@ -10,26 +10,34 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var (
-	ErrCantFindProduct = errors.New("can't find product")
-	ErrCantDecodeProducts = errors.New("can't find product")
-	ErrUserIdIsNotValid = errors.New("user_id is not valid")
-	ErrCantUpdateUser = errors.New("can't update user")
-	ErrCantRemoveItemCart = errors.New("can't remove item from cart")
-	ErrCantGetItem = errors.New("can't get item from cart")
-	ErrCantBuyCartItem = errors.New("can't buy cart item")
+	ErrCantFindProduct = NewError(KindNotFound, "product_not_found", "can't find product")
+	ErrCantDecodeProducts = NewError(KindInternal, "cant_decode_products", "can't find product")
+	ErrUserIdIsNotValid = NewError(KindNotFound, "user_not_found", "user not found")
+	ErrCantUpdateUser = NewError(KindInternal, "cant_update_user", "can't update user")
+	ErrCantRemoveItemCart = NewError(KindInternal, "cant_remove_cart_item", "can't remove item from cart")
+	ErrCantGetItem = NewError(KindNotFound, "cart_item_not_found", "product is not in the cart")
+	ErrCantBuyCartItem = NewError(KindInternal, "cant_buy_cart_item", "can't buy cart item")
+	ErrCartIsEmpty = NewError(KindConflict, "cart_empty", "cart is empty")
+	ErrInvalidQuantity = NewError(KindInvalid, "invalid_quantity", "quantity is not valid")
 )
 
-func AddProductToCart(ctx context.Context, productCollection *mongo.Collection, userCollection *mongo.Collection, productID primitive.ObjectID, userID string) error {
-	searchFromDB, err := productCollection.Find(ctx, bson.M{"_id": productID})
-	if err != nil {
-		log.Println(err)
+// AddProductToCart adds quantity units of the product to the user's cart,
+// growing the existing line if the product is already there. The units are
+// reserved for the cart for ReservationTTL.
+func AddProductToCart(ctx context.Context, productCollection *mongo.Collection, userCollection *mongo.Collection, reservationCollection *mongo.Collection, productID primitive.ObjectID, userID string, quantity int) error {
+	if quantity < 1 {
+		return ErrInvalidQuantity
+	}
+
+	var productCart models.ProductUser
+	err := productCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: productID}, NotDeleted}).Decode(&productCart)
+	if err == mongo.ErrNoDocuments {
 		return ErrCantFindProduct
-	} 
-	var productCart []models.ProductUser 
-	err = searchFromDB.All(ctx, &productCart)
+	}
 	if err != nil {
 		log.Println(err)
 		return ErrCantDecodeProducts
@@ -40,146 +48,279 @@ func AddProductToCart(ctx context.Context, productCollection *mongo.Collection,
 		return ErrUserIdIsNotValid
 	}
 
-	filter := bson.D{primitive.E{Key: "_id", Value: id}}
-	update := bson.D{{Key: "$push", Value: bson.D{primitive.E{Key: "usercart", Value: bson.D{{Key: "$each", Value: productCart}}}}}}
-
-	_, err = userCollection.UpdateOne(ctx, filter, update)
+	_, err = runInTransaction(ctx, userCollection, func(sc mongo.SessionContext) (interface{}, error) {
+		if err := ReserveStock(sc, productCollection, reservationCollection, userID, productID, quantity); err != nil {
+			return nil, err
+		}
+
+		// Grow an existing line first; only push a new line when the product
+		// isn't in the cart yet.
+		filter := bson.D{primitive.E{Key: "_id", Value: id}, {Key: "usercart._id", Value: productID}}
+		update := bson.D{{Key: "$inc", Value: bson.D{primitive.E{Key: "usercart.$.quantity", Value: quantity}}}}
+
+		result, err := userCollection.UpdateOne(sc, filter, update)
+		if err != nil || result.MatchedCount > 0 {
+			return nil, err
+		}
+
+		productCart.Quantity = quantity
+		filter = bson.D{primitive.E{Key: "_id", Value: id}}
+		update = bson.D{{Key: "$push", Value: bson.D{primitive.E{Key: "usercart", Value: productCart}}}}
+
+		result, err = userCollection.UpdateOne(sc, filter, update)
+		if err == nil && result.MatchedCount == 0 {
+			return nil, ErrUserIdIsNotValid
+		}
+		return nil, err
+	})
+
+	if errors.Is(err, ErrNotEnoughStock) || errors.Is(err, ErrUserIdIsNotValid) {
+		return err
+	}
 	if err != nil {
+		log.Println(err)
 		return ErrCantUpdateUser
 	}
 
 	return nil
 }
 
-func RemoveCartItem(ctx context.Context, productCollection *mongo.Collection, userCollection *mongo.Collection, productID primitive.ObjectID, userID string) error {
-	id , err := primitive.ObjectIDFromHex(userID)
+// SetCartItemQuantity sets the quantity of a product already in the user's
+// cart, reserving or releasing stock for the difference. A quantity of zero
+// removes the line.
+func SetCartItemQuantity(ctx context.Context, productCollection *mongo.Collection, userCollection *mongo.Collection, reservationCollection *mongo.Collection, productID primitive.ObjectID, userID string, quantity int) error {
+	if quantity < 0 {
+		return ErrInvalidQuantity
+	}
+
+	id, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
 		log.Println(err)
 		return ErrUserIdIsNotValid
 	}
 
-	filter := bson.D{primitive.E{Key: "_id", Value: id}}
-	update := bson.M{"$pull":bson.M{"usercart": bson.M{"_id":productID}}}
-	_, err = userCollection.UpdateMany(ctx, filter, update)
+	_, err = runInTransaction(ctx, userCollection, func(sc mongo.SessionContext) (interface{}, error) {
+		filter := bson.D{primitive.E{Key: "_id", Value: id}, {Key: "usercart._id", Value: productID}}
+
+		var user models.User
+		err := userCollection.FindOne(sc, filter).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrCantGetItem
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		current := 0
+		for _, item := range user.UserCart {
+			if item.Product_ID == productID {
+				current += item.Quantity
+			}
+		}
+
+		switch delta := quantity - current; {
+		case quantity == 0:
+			err = ReleaseStock(sc, productCollection, reservationCollection, userID, productID, 0)
+		case delta > 0:
+			err = ReserveStock(sc, productCollection, reservationCollection, userID, productID, delta)
+		case delta < 0:
+			err = ReleaseStock(sc, productCollection, reservationCollection, userID, productID, -delta)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "usercart.$.quantity", Value: quantity}}}}
+		if quantity == 0 {
+			update = bson.D{{Key: "$pull", Value: bson.D{primitive.E{Key: "usercart", Value: bson.D{primitive.E{Key: "_id", Value: productID}}}}}}
+		}
+
+		return userCollection.UpdateOne(sc, filter, update)
+	})
+
+	if errors.Is(err, ErrCantGetItem) || errors.Is(err, ErrNotEnoughStock) {
+		return err
+	}
 	if err != nil {
-		return ErrCantRemoveItemCart
+		log.Println(err)
+		return ErrCantUpdateUser
 	}
 
 	return nil
 }
 
-func BuyItemFromCart(ctx context.Context, userCollection *mongo.Collection, userID string) error{
-	id, err := primitive.ObjectIDFromHex(userID)
+// MigrateCartQuantities gives cart lines written before quantities existed
+// an explicit quantity of one.
+func MigrateCartQuantities(ctx context.Context, userCollection *mongo.Collection) error {
+	missing := bson.D{primitive.E{Key: "quantity", Value: bson.D{primitive.E{Key: "$exists", Value: false}}}}
+	filter := bson.D{primitive.E{Key: "usercart", Value: bson.D{primitive.E{Key: "$elemMatch", Value: missing}}}}
+	update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "usercart.$[line].quantity", Value: 1}}}}
+	opts := options.Update().SetArrayFilters(options.ArrayFilters{
+		Filters: []interface{}{bson.D{primitive.E{Key: "line.quantity", Value: bson.D{primitive.E{Key: "$exists", Value: false}}}}},
+	})
+
+	_, err := userCollection.UpdateMany(ctx, filter, update, opts)
+	return err
+}
+
+func RemoveCartItem(ctx context.Context, productCollection *mongo.Collection, userCollection *mongo.Collection, reservationCollection *mongo.Collection, productID primitive.ObjectID, userID string) error {
+	id , err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
 		log.Println(err)
 		return ErrUserIdIsNotValid
 	}
 
-	var getCartItems models.User
-	var orderCart models.Order
-
-	orderCart.Order_ID = primitive.NewObjectID()
-	orderCart.Ordered_At = time.Now()
-	orderCart.Order_Cart = make([]models.ProductUser, 0)
-	orderCart.Payment_Method.COD = true
+	_, err = runInTransaction(ctx, userCollection, func(sc mongo.SessionContext) (interface{}, error) {
+		if err := ReleaseStock(sc, productCollection, reservationCollection, userID, productID, 0); err != nil {
+			return nil, err
+		}
 
-	unwind := bson.D{{Key: "$unwind", Value: bson.D{primitive.E{Key: "path", Value: "$usercart"}}}}
-	grouping := bson.D{{Key: "$group", Value: bson.D{primitive.E{Key: "_id", Value: "$_id"}, {Key: "total", Value: bson.D{primitive.E{Key: "$sum", Value: "$usercart.price"}}}}}}
-	
-	currentResults, err := userCollection.Aggregate(ctx, mongo.Pipeline{unwind, grouping})
-
-	ctx.Done()
+		filter := bson.D{primitive.E{Key: "_id", Value: id}}
+		update := bson.M{"$pull":bson.M{"usercart": bson.M{"_id":productID}}}
+		return userCollection.UpdateOne(sc, filter, update)
+	})
 	if err != nil {
-		panic(err)
-	}
-
-	var getUserCart []bson.M
-	if err = currentResults.All(ctx, &getUserCart); err != nil {
-		panic(err)
-	}
-
-	var totalPrice int32
-
-	for _, user_item := range getUserCart{
-		price := user_item["total"]
-		totalPrice = price.(int32)
+		log.Println(err)
+		return ErrCantRemoveItemCart
 	}
 
-	orderCart.Price = int(totalPrice)
+	return nil
+}
 
-	filter := bson.D{primitive.E{Key: "_id", Value: id}}
-	update := bson.D{{Key: "$push", Value: bson.D{primitive.E{Key: "orders", Value: orderCart}}}}
+// BuyItemFromCart turns the user's cart into an order shipped to the address
+// picked by addresses. Snapshotting the cart and the addresses, taking the
+// stock, inserting the order and emptying the cart run in a single
+// transaction, so either all of them happen or none do.
+func BuyItemFromCart(ctx context.Context, productCollection *mongo.Collection, userCollection *mongo.Collection, orderCollection *mongo.Collection, reservationCollection *mongo.Collection, userID string, addresses AddressChoice) (models.Order, error){
+	var orderCart models.Order
 
-	_, err = userCollection.UpdateMany(ctx, filter, update)
+	id, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
 		log.Println(err)
+		return orderCart, ErrUserIdIsNotValid
 	}
 
-	err = userCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: id}}).Decode(&getCartItems)
-	if err != nil {
-		log.Println(err)
+	_, err = runInTransaction(ctx, userCollection, func(sc mongo.SessionContext) (interface{}, error) {
+		var getCartItems models.User
+		err := userCollection.FindOne(sc, bson.D{primitive.E{Key: "_id", Value: id}}).Decode(&getCartItems)
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrUserIdIsNotValid
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(getCartItems.UserCart) == 0 {
+			return nil, ErrCartIsEmpty
+		}
+
+		shipping, billing, err := orderAddresses(getCartItems, addresses)
+		if err != nil {
+			return nil, err
+		}
+
+		pricing, err := PriceCart(sc, productCollection, getCartItems.UserCart)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := takeStock(sc, productCollection, reservationCollection, userID, pricing.Lines); err != nil {
+			return nil, err
+		}
+
+		orderCart = models.Order{}
+		orderCart.Order_ID = primitive.NewObjectID()
+		orderCart.User_ID = userID
+		orderCart.Ordered_At = time.Now()
+		orderCart.Order_Cart = pricing.Reprice(getCartItems.UserCart)
+		orderCart.Price = pricing.Total
+		orderCart.Discount = &pricing.Discount
+		orderCart.Payment_Method.COD = true
+		orderCart.Status = models.OrderPending
+		orderCart.Status_History = NewOrderHistory(userID, orderCart.Ordered_At)
+		orderCart.Shipping_Address = shipping
+		orderCart.Billing_Address = billing
+
+		if _, err = orderCollection.InsertOne(sc, orderCart); err != nil {
+			return nil, err
+		}
+
+		userCartEmpty := make([]models.ProductUser, 0)
+
+		filtered := bson.D{primitive.E{Key: "_id", Value: id}}
+		updated := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "usercart", Value: userCartEmpty}}}}
+
+		return userCollection.UpdateOne(sc, filtered, updated)
+	})
+
+	var outOfStock *OutOfStockError
+	if errors.Is(err, ErrUserIdIsNotValid) || errors.Is(err, ErrCartIsEmpty) || errors.Is(err, ErrAddressNotFound) || errors.Is(err, ErrShippingAddressRequired) || errors.Is(err, ErrCantFindProduct) || errors.Is(err, ErrCantPriceCart) || errors.As(err, &outOfStock) {
+		return orderCart, err
 	}
-
-	filter2 := bson.D{primitive.E{Key: "_id", Value: id}}
-	update2 := bson.M{"$push":bson.M{"orders.$[].order_list": bson.M{"$each":getCartItems.UserCart}}}
-
-	_, err = userCollection.UpdateOne(ctx, filter2, update2)
 	if err != nil {
 		log.Println(err)
+		return orderCart, ErrCantBuyCartItem
 	}
 
-	userCartEmpty := make([]models.ProductUser, 0)
+	return orderCart, nil
+}
 
-	filtered := bson.D{primitive.E{Key: "_id", Value: id}}
-	updated := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "usercart", Value: userCartEmpty}}}}
+// InstantBuyer orders a single unit of a product without going through the
+// cart, shipped to the address picked by addresses. The stock is taken and
+// the order inserted in one transaction.
+func InstantBuyer(ctx context.Context, productCollection *mongo.Collection, userCollection *mongo.Collection, orderCollection *mongo.Collection, reservationCollection *mongo.Collection, productID primitive.ObjectID, userID string, addresses AddressChoice) (models.Order, error){
+	var orderDetails models.Order
 
-	_, err = userCollection.UpdateOne(ctx, filtered, updated)
+	user, err := GetUser(ctx, userCollection, userID)
 	if err != nil {
-		return ErrCantBuyCartItem
+		return orderDetails, err
 	}
 
-	return nil
-}
-
-func InstantBuyer(ctx context.Context, productCollection *mongo.Collection, userCollection *mongo.Collection, productID primitive.ObjectID, userID string) error{
-	id, err := primitive.ObjectIDFromHex(userID)
-
+	shipping, billing, err := orderAddresses(user, addresses)
 	if err != nil {
-		log.Println(err)
-		return ErrUserIdIsNotValid
+		return orderDetails, err
 	}
 
 	var productDetails models.ProductUser
-	var orderDetails models.Order
-
-	orderDetails.Order_ID = primitive.NewObjectID()
-	orderDetails.Ordered_At = time.Now()
-	orderDetails.Order_Cart = make([]models.ProductUser, 0)
-	orderDetails.Payment_Method.COD = true
-	err = productCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: productID}}).Decode(&productDetails)
-
+	err = productCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: productID}, NotDeleted}).Decode(&productDetails)
 	if err != nil {
 		log.Println(err)
+		return orderDetails, ErrCantFindProduct
 	}
 
-	orderDetails.Price = productDetails.Price
-
-	filter := bson.D{primitive.E{Key: "_id", Value: id}}
-	update := bson.D{{Key: "$push", Value: bson.D{primitive.E{Key: "orders", Value: orderDetails}}}}
+	productDetails.Quantity = 1
 
-	_, err = userCollection.UpdateOne(ctx, filter, update)
+	orderDetails.Order_ID = primitive.NewObjectID()
+	orderDetails.User_ID = userID
+	orderDetails.Ordered_At = time.Now()
+	orderDetails.Order_Cart = []models.ProductUser{productDetails}
+	pricing, err := PriceCart(ctx, productCollection, orderDetails.Order_Cart)
 	if err != nil {
-		log.Println(err)
+		return orderDetails, err
+	}
+	orderDetails.Price = pricing.Total
+	orderDetails.Discount = &pricing.Discount
+	orderDetails.Payment_Method.COD = true
+	orderDetails.Status = models.OrderPending
+	orderDetails.Status_History = NewOrderHistory(userID, orderDetails.Ordered_At)
+	orderDetails.Shipping_Address = shipping
+	orderDetails.Billing_Address = billing
+
+	_, err = runInTransaction(ctx, orderCollection, func(sc mongo.SessionContext) (interface{}, error) {
+		if err := takeStock(sc, productCollection, reservationCollection, userID, pricing.Lines); err != nil {
+			return nil, err
+		}
+		return orderCollection.InsertOne(sc, orderDetails)
+	})
+
+	var outOfStock *OutOfStockError
+	if errors.As(err, &outOfStock) {
+		return orderDetails, err
 	}
-
-
-	filter2 := bson.D{primitive.E{Key: "_id", Value: id}}
-	update2 := bson.M{"$push": bson.M{"orders.$[].order_list":productDetails}}
-
-	_, err = userCollection.UpdateOne(ctx, filter2, update2)
 	if err != nil {
 		log.Println(err)
+		return orderDetails, ErrCantBuyCartItem
 	}
 
-	return nil
-} 
\ No newline at end of file
+	return orderDetails, nil
+}
@@ -0,0 +1,247 @@
+package database
+
+import (
+	"context"
+	"encoding/base64"
+	"log"
+
+	"github.com/GadirB/ecommerce-go/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrInvalidCursor = NewError(KindInvalid, "invalid_cursor", "cursor is not valid")
+	ErrUnknownSort = NewError(KindInvalid, "unknown_sort", "sort must be one of newest, price_asc, price_desc, rating or name")
+	ErrCantListCatalog = NewError(KindInternal, "cant_list_catalog", "can't list products")
+)
+
+type catalogOrder struct {
+	Field string
+	Descending bool
+	// Types are the BSON types the field is stored as. A cursor's value
+	// must be one of them or null.
+	Types []bsontype.Type
+}
+
+var numberTypes = []bsontype.Type{bsontype.Int32, bsontype.Int64, bsontype.Double}
+
+// CatalogSorts are the orders the catalog can be listed in. Ties are broken
+// by _id in the same direction, so every product has a fixed place.
+var CatalogSorts = map[string]catalogOrder{
+	"newest": {Field: "created_at", Descending: true, Types: []bsontype.Type{bsontype.DateTime}},
+	"price_asc": {Field: "price", Types: numberTypes},
+	"price_desc": {Field: "price", Descending: true, Types: numberTypes},
+	"rating": {Field: "rating", Descending: true, Types: numberTypes},
+	"name": {Field: "product_name", Types: []bsontype.Type{bsontype.String}},
+}
+
+const DefaultCatalogSort = "newest"
+
+// CatalogQuery asks for one page of the catalog. Cursor is the Next_Cursor
+// of the previous page, or empty for the first one. Fields, if set, are the
+// bson fields to load; _id and the sort field are always loaded.
+type CatalogQuery struct {
+	Sort string
+	Cursor string
+	Limit int64
+	Fields []string
+}
+
+type CatalogPage struct {
+	Products []models.Product
+	// Next_Cursor continues after the last product, or is empty on the last
+	// page.
+	Next_Cursor string
+	// Total is the number of products in the catalog.
+	Total int64
+}
+
+// catalogCursor is where a page ended: the sort value and id of its last
+// product. Value is the raw stored value, so it compares in the query
+// exactly as stored, null included. Cursors come back from clients, so
+// ListCatalog only accepts values of the sort field's types; anything else,
+// such as a document of query operators, is rejected.
+type catalogCursor struct {
+	Sort string `bson:"s"`
+	Value bson.RawValue `bson:"v"`
+	ID primitive.ObjectID `bson:"id"`
+}
+
+func encodeCatalogCursor(cursor catalogCursor) (string, error) {
+	data, err := bson.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCatalogCursor(token string) (catalogCursor, error) {
+	var cursor catalogCursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return cursor, ErrInvalidCursor
+	}
+	if err = bson.Unmarshal(data, &cursor); err != nil || cursor.ID.IsZero() {
+		return cursor, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+// accepts reports whether value can be a cursor value for the order.
+func (o catalogOrder) accepts(value bson.RawValue) bool {
+	if value.Type == bsontype.Null {
+		return true
+	}
+	for _, valueType := range o.Types {
+		if value.Type == valueType {
+			return value.Validate() == nil
+		}
+	}
+	return false
+}
+
+// after matches the products that come after the cursor in order. Products
+// without the sort field sort before all others ascending and after them
+// descending, like MongoDB sorts nulls.
+func (o catalogOrder) after(cursor catalogCursor) bson.D {
+	isNull := cursor.Value.Type == bsontype.Null
+	beyond := "$gt"
+	if o.Descending {
+		beyond = "$lt"
+	}
+
+	sameValueLaterID := bson.D{primitive.E{Key: o.Field, Value: cursor.Value}, {Key: "_id", Value: bson.D{primitive.E{Key: beyond, Value: cursor.ID}}}}
+	if isNull {
+		sameValueLaterID[0].Value = nil
+	}
+
+	var branches bson.A
+	switch {
+	case isNull && o.Descending:
+		branches = bson.A{sameValueLaterID}
+	case isNull:
+		branches = bson.A{sameValueLaterID, bson.D{primitive.E{Key: o.Field, Value: bson.D{primitive.E{Key: "$ne", Value: nil}}}}}
+	case o.Descending:
+		branches = bson.A{
+			bson.D{primitive.E{Key: o.Field, Value: bson.D{primitive.E{Key: beyond, Value: cursor.Value}}}},
+			sameValueLaterID,
+			bson.D{primitive.E{Key: o.Field, Value: nil}},
+		}
+	default:
+		branches = bson.A{
+			bson.D{primitive.E{Key: o.Field, Value: bson.D{primitive.E{Key: beyond, Value: cursor.Value}}}},
+			sameValueLaterID,
+		}
+	}
+	return bson.D{primitive.E{Key: "$or", Value: branches}}
+}
+
+// EnsureCatalogIndexes creates the indexes ListCatalog pages through, one
+// per sort.
+func EnsureCatalogIndexes(ctx context.Context, productCollection *mongo.Collection) error {
+	var indexes []mongo.IndexModel
+	seen := make(map[string]bool)
+	for _, order := range CatalogSorts {
+		if seen[order.Field] {
+			continue
+		}
+		seen[order.Field] = true
+		indexes = append(indexes, mongo.IndexModel{Keys: bson.D{{Key: order.Field, Value: 1}, {Key: "_id", Value: 1}}})
+	}
+	_, err := productCollection.Indexes().CreateMany(ctx, indexes)
+	return err
+}
+
+// ListCatalog returns one page of the products customers can buy.
+func ListCatalog(ctx context.Context, productCollection *mongo.Collection, query CatalogQuery) (CatalogPage, error) {
+	page := CatalogPage{Products: make([]models.Product, 0)}
+
+	if query.Sort == "" {
+		query.Sort = DefaultCatalogSort
+	}
+	order, known := CatalogSorts[query.Sort]
+	if !known {
+		return page, ErrUnknownSort
+	}
+
+	filter := bson.D{NotDeleted}
+
+	total, err := productCollection.CountDocuments(ctx, filter)
+	if err != nil {
+		log.Println(err)
+		return page, ErrCantListCatalog
+	}
+	page.Total = total
+
+	if query.Cursor != "" {
+		cursor, err := decodeCatalogCursor(query.Cursor)
+		if err != nil {
+			return page, err
+		}
+		if cursor.Sort != query.Sort || !order.accepts(cursor.Value) {
+			return page, ErrInvalidCursor
+		}
+		filter = append(filter, order.after(cursor)...)
+	}
+
+	direction := 1
+	if order.Descending {
+		direction = -1
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: order.Field, Value: direction}, {Key: "_id", Value: direction}}).
+		SetLimit(query.Limit + 1)
+
+	if len(query.Fields) > 0 {
+		projection := bson.D{{Key: "_id", Value: 1}, {Key: order.Field, Value: 1}}
+		for _, field := range query.Fields {
+			if field != "_id" && field != order.Field {
+				projection = append(projection, bson.E{Key: field, Value: 1})
+			}
+		}
+		opts.SetProjection(projection)
+	}
+
+	results, err := productCollection.Find(ctx, filter, opts)
+	if err != nil {
+		log.Println(err)
+		return page, ErrCantListCatalog
+	}
+	defer results.Close(ctx)
+
+	var last catalogCursor
+	for results.Next(ctx) {
+		if int64(len(page.Products)) == query.Limit {
+			next, err := encodeCatalogCursor(last)
+			if err != nil {
+				log.Println(err)
+				return page, ErrCantListCatalog
+			}
+			page.Next_Cursor = next
+			break
+		}
+
+		var product models.Product
+		if err := results.Decode(&product); err != nil {
+			log.Println(err)
+			return page, ErrCantListCatalog
+		}
+		page.Products = append(page.Products, product)
+
+		value, err := results.Current.LookupErr(order.Field)
+		if err != nil {
+			value = bson.RawValue{Type: bsontype.Null}
+		}
+		last = catalogCursor{Sort: query.Sort, Value: value, ID: product.Product_ID}
+	}
+	if err := results.Err(); err != nil {
+		log.Println(err)
+		return page, ErrCantListCatalog
+	}
+
+	return page, nil
+}
@@ -0,0 +1,59 @@
+package database
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func cursorWithValue(t *testing.T, sort string, value interface{}) catalogCursor {
+	t.Helper()
+	data, err := bson.Marshal(bson.D{{Key: "v", Value: value}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return catalogCursor{Sort: sort, Value: bson.Raw(data).Lookup("v"), ID: primitive.NewObjectID()}
+}
+
+func TestCatalogCursorRoundTrip(t *testing.T) {
+	cursor := cursorWithValue(t, "price_asc", int64(4500))
+	token, err := encodeCatalogCursor(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeCatalogCursor(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Sort != cursor.Sort || decoded.ID != cursor.ID || !sameValue(decoded.Value, cursor.Value) {
+		t.Errorf("decoded %+v, want %+v", decoded, cursor)
+	}
+	if !CatalogSorts["price_asc"].accepts(decoded.Value) {
+		t.Error("a price cursor was rejected")
+	}
+}
+
+func TestCatalogCursorRejectsOtherTypes(t *testing.T) {
+	tests := []struct {
+		sort string
+		value interface{}
+	}{
+		{"name", bson.D{{Key: "$regex", Value: "(a+)+$"}}},
+		{"name", bson.D{{Key: "$ne", Value: nil}}},
+		{"name", bson.A{"a", "b"}},
+		{"price_asc", "4500"},
+		{"newest", int64(0)},
+		{"rating", primitive.Regex{Pattern: ".*"}},
+	}
+	for _, test := range tests {
+		cursor := cursorWithValue(t, test.sort, test.value)
+		if CatalogSorts[test.sort].accepts(cursor.Value) {
+			t.Errorf("%s cursor accepted %v", test.sort, test.value)
+		}
+	}
+
+	if !CatalogSorts["name"].accepts(cursorWithValue(t, "name", nil).Value) {
+		t.Error("a null cursor value was rejected")
+	}
+}
@@ -26,7 +26,7 @@ func DBSet() *mongo.Client{
 		log.Fatal(err)
 	}
 
-	err = client.Ping(context.TODO(), nil)
+	err = client.Ping(ctx, nil)
 	if err!=nil {
 		log.Println("failed to connect to mongodb")
 		return nil
@@ -46,4 +46,37 @@ func UserData(client *mongo.Client, collectionName string) *mongo.Collection{
 func ProductData(client *mongo.Client, collectionName string) *mongo.Collection{
 	var productCollection *mongo.Collection = client.Database("Ecommerce").Collection(collectionName)
 	return productCollection
-}
\ No newline at end of file
+}
+
+func OrderData(client *mongo.Client, collectionName string) *mongo.Collection{
+	var orderCollection *mongo.Collection = client.Database("Ecommerce").Collection(collectionName)
+	return orderCollection
+}
+
+
+func ReservationData(client *mongo.Client, collectionName string) *mongo.Collection{
+	var reservationCollection *mongo.Collection = client.Database("Ecommerce").Collection(collectionName)
+	return reservationCollection
+}
+
+func RefreshTokenData(client *mongo.Client, collectionName string) *mongo.Collection{
+	var refreshTokenCollection *mongo.Collection = client.Database("Ecommerce").Collection(collectionName)
+	return refreshTokenCollection
+}
+
+func RevocationData(client *mongo.Client, collectionName string) *mongo.Collection{
+	var revocationCollection *mongo.Collection = client.Database("Ecommerce").Collection(collectionName)
+	return revocationCollection
+}
+
+// runInTransaction runs fn inside a multi-document transaction on the client
+// that owns collection, retrying it on transient errors.
+func runInTransaction(ctx context.Context, collection *mongo.Collection, fn func(sc mongo.SessionContext) (interface{}, error)) (interface{}, error) {
+	session, err := collection.Database().Client().StartSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.EndSession(ctx)
+
+	return session.WithTransaction(ctx, fn)
+}
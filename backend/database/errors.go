@@ -0,0 +1,58 @@
+package database
+
+import "errors"
+
+// ErrorKind says what went wrong in terms the API maps to an HTTP status.
+type ErrorKind int
+
+const (
+	KindInternal ErrorKind = iota
+	KindInvalid
+	KindUnauthorized
+	KindForbidden
+	KindNotFound
+	KindConflict
+	KindTooManyRequests
+	KindUnavailable
+)
+
+// Error is a domain error. Code is a stable machine-readable name for it
+// and Message is safe to show to the client.
+type Error struct {
+	Kind ErrorKind
+	Code string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func NewError(kind ErrorKind, code string, message string) *Error {
+	return &Error{Kind: kind, Code: code, Message: message}
+}
+
+// InvalidInput is the error for a request the client has to fix, such as a
+// malformed query parameter.
+func InvalidInput(message string) *Error {
+	return NewError(KindInvalid, "invalid_input", message)
+}
+
+// detailedError is implemented by errors that carry more than their
+// message, such as which cart lines are out of stock.
+type detailedError interface {
+	Details() interface{}
+}
+
+// AsError finds the domain error in err's chain together with its details,
+// if it has any. ok is false when err isn't a domain error.
+func AsError(err error) (domainErr *Error, details interface{}, ok bool) {
+	if !errors.As(err, &domainErr) {
+		return nil, nil, false
+	}
+	var detailed detailedError
+	if errors.As(err, &detailed) {
+		details = detailed.Details()
+	}
+	return domainErr, details, true
+}
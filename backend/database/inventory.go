@@ -0,0 +1,330 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/GadirB/ecommerce-go/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrNotEnoughStock = NewError(KindConflict, "out_of_stock", "not enough stock")
+	ErrStockBelowReserved = NewError(KindConflict, "stock_below_reserved", "stock can't go below the units currently reserved")
+	ErrCantReserveStock = NewError(KindInternal, "cant_reserve_stock", "can't reserve stock")
+	ErrCantUpdateProduct = NewError(KindInternal, "cant_update_product", "can't update product")
+)
+
+// ReservationTTL is how long units put in a cart stay held for that cart.
+var ReservationTTL = 15 * time.Minute
+
+// OutOfStockLine describes one cart line that couldn't be fulfilled.
+type OutOfStockLine struct {
+	Product_ID primitive.ObjectID `json:"product_id"`
+	Product_Name *string `json:"product_name"`
+	Requested int `json:"requested"`
+	Available int `json:"available"`
+}
+
+// OutOfStockError is returned by checkout when one or more lines can't be
+// fulfilled from the current stock. No stock is taken when it is returned.
+type OutOfStockError struct {
+	Lines []OutOfStockLine
+}
+
+func (e *OutOfStockError) Error() string {
+	names := make([]string, 0, len(e.Lines))
+	for _, line := range e.Lines {
+		if line.Product_Name != nil {
+			names = append(names, *line.Product_Name)
+		} else {
+			names = append(names, line.Product_ID.Hex())
+		}
+	}
+	return fmt.Sprintf("out of stock: %s", strings.Join(names, ", "))
+}
+
+func (e *OutOfStockError) Unwrap() error {
+	return ErrNotEnoughStock
+}
+
+func (e *OutOfStockError) Details() interface{} {
+	return e.Lines
+}
+
+// availableAtLeast matches products on sale whose unreserved stock covers
+// quantity.
+func availableAtLeast(productID primitive.ObjectID, quantity int) bson.D {
+	return bson.D{
+		primitive.E{Key: "_id", Value: productID},
+		NotDeleted,
+		{Key: "$expr", Value: bson.D{primitive.E{Key: "$gte", Value: bson.A{
+			bson.D{primitive.E{Key: "$subtract", Value: bson.A{"$stock", "$reserved"}}},
+			quantity,
+		}}}},
+	}
+}
+
+// EnsureReservationIndexes creates the indexes used to look up a user's
+// reservations and to find expired ones.
+func EnsureReservationIndexes(ctx context.Context, reservationCollection *mongo.Collection) error {
+	_, err := reservationCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "product_id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "expires_at", Value: 1}},
+		},
+	})
+	return err
+}
+
+// MigrateProductStock gives products created before inventory tracking an
+// explicit stock of zero, so they can't be sold until stock is set.
+func MigrateProductStock(ctx context.Context, productCollection *mongo.Collection) error {
+	for _, field := range []string{"stock", "reserved"} {
+		filter := bson.D{primitive.E{Key: field, Value: bson.D{primitive.E{Key: "$exists", Value: false}}}}
+		update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: field, Value: 0}}}}
+		result, err := productCollection.UpdateMany(ctx, filter, update)
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount > 0 {
+			log.Printf("set %s to 0 on %d products", field, result.ModifiedCount)
+		}
+	}
+	return nil
+}
+
+// SetProductStock sets the number of units on hand for a product.
+func SetProductStock(ctx context.Context, productCollection *mongo.Collection, productID primitive.ObjectID, stock int) error {
+	if stock < 0 {
+		return ErrInvalidQuantity
+	}
+
+	filter := bson.D{
+		primitive.E{Key: "_id", Value: productID},
+		{Key: "reserved", Value: bson.D{primitive.E{Key: "$lte", Value: stock}}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "stock", Value: stock}}}}
+
+	result, err := productCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		log.Println(err)
+		return ErrCantUpdateProduct
+	}
+	if result.MatchedCount == 0 {
+		count, err := productCollection.CountDocuments(ctx, bson.D{primitive.E{Key: "_id", Value: productID}})
+		if err == nil && count == 0 {
+			return ErrCantFindProduct
+		}
+		return ErrStockBelowReserved
+	}
+
+	return nil
+}
+
+// ReserveStock holds quantity more units of the product for the user's cart
+// and pushes the reservation's expiry out by ReservationTTL.
+func ReserveStock(ctx context.Context, productCollection *mongo.Collection, reservationCollection *mongo.Collection, userID string, productID primitive.ObjectID, quantity int) error {
+	if quantity < 1 {
+		return ErrInvalidQuantity
+	}
+
+	result, err := productCollection.UpdateOne(ctx, availableAtLeast(productID, quantity), bson.D{{Key: "$inc", Value: bson.D{primitive.E{Key: "reserved", Value: quantity}}}})
+	if err != nil {
+		log.Println(err)
+		return ErrCantReserveStock
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotEnoughStock
+	}
+
+	filter := bson.D{primitive.E{Key: "user_id", Value: userID}, {Key: "product_id", Value: productID}}
+	update := bson.D{
+		{Key: "$inc", Value: bson.D{primitive.E{Key: "quantity", Value: quantity}}},
+		{Key: "$set", Value: bson.D{primitive.E{Key: "expires_at", Value: time.Now().Add(ReservationTTL)}}},
+	}
+	_, err = reservationCollection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		log.Println(err)
+		return ErrCantReserveStock
+	}
+
+	return nil
+}
+
+// ReleaseStock gives back up to quantity units the user holds on a product.
+// A quantity below one releases the whole reservation. It must run inside a
+// transaction, and only gives back units it took off the reservation, so a
+// release racing another one can't count them back twice.
+func ReleaseStock(ctx context.Context, productCollection *mongo.Collection, reservationCollection *mongo.Collection, userID string, productID primitive.ObjectID, quantity int) error {
+	filter := bson.D{primitive.E{Key: "user_id", Value: userID}, {Key: "product_id", Value: productID}}
+
+	var reservation models.Reservation
+	err := reservationCollection.FindOne(ctx, filter).Decode(&reservation)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		log.Println(err)
+		return ErrCantReserveStock
+	}
+
+	released := false
+	if quantity < 1 || quantity >= reservation.Quantity {
+		quantity = reservation.Quantity
+		var result *mongo.DeleteResult
+		result, err = reservationCollection.DeleteOne(ctx, bson.D{primitive.E{Key: "_id", Value: reservation.Reservation_ID}, {Key: "quantity", Value: reservation.Quantity}})
+		released = err == nil && result.DeletedCount == 1
+	} else {
+		filter := bson.D{primitive.E{Key: "_id", Value: reservation.Reservation_ID}, {Key: "quantity", Value: bson.D{primitive.E{Key: "$gt", Value: quantity}}}}
+		var result *mongo.UpdateResult
+		result, err = reservationCollection.UpdateOne(ctx, filter, bson.D{{Key: "$inc", Value: bson.D{primitive.E{Key: "quantity", Value: -quantity}}}})
+		released = err == nil && result.ModifiedCount == 1
+	}
+	if err != nil {
+		log.Println(err)
+		return ErrCantReserveStock
+	}
+	if !released {
+		return nil
+	}
+
+	_, err = productCollection.UpdateOne(ctx, bson.D{primitive.E{Key: "_id", Value: productID}}, bson.D{{Key: "$inc", Value: bson.D{primitive.E{Key: "reserved", Value: -quantity}}}})
+	if err != nil {
+		log.Println(err)
+		return ErrCantReserveStock
+	}
+
+	return nil
+}
+
+// takeStock converts the user's reservations into sold units for every line,
+// decrementing stock only where enough unreserved stock remains. It must run
+// inside a transaction: when any line is short, the returned OutOfStockError
+// aborts it and nothing is taken.
+func takeStock(sc mongo.SessionContext, productCollection *mongo.Collection, reservationCollection *mongo.Collection, userID string, lines []PricedLine) error {
+	var short []OutOfStockLine
+
+	for _, line := range lines {
+		if err := ReleaseStock(sc, productCollection, reservationCollection, userID, line.Product_ID, 0); err != nil {
+			return err
+		}
+
+		update := bson.D{{Key: "$inc", Value: bson.D{primitive.E{Key: "stock", Value: -line.Quantity}}}}
+		result, err := productCollection.UpdateOne(sc, availableAtLeast(line.Product_ID, line.Quantity), update)
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount > 0 {
+			continue
+		}
+
+		var product models.Product
+		available := 0
+		// A product deleted since it was put in the cart can't be sold.
+		if err := productCollection.FindOne(sc, bson.D{primitive.E{Key: "_id", Value: line.Product_ID}}).Decode(&product); err == nil && product.Deleted_At == nil {
+			available = product.Stock - product.Reserved
+			if available < 0 {
+				available = 0
+			}
+		}
+		short = append(short, OutOfStockLine{
+			Product_ID: line.Product_ID,
+			Product_Name: line.Product_Name,
+			Requested: line.Quantity,
+			Available: available,
+		})
+	}
+
+	if len(short) > 0 {
+		return &OutOfStockError{Lines: short}
+	}
+	return nil
+}
+
+// ReleaseExpiredReservations returns the units held by every reservation
+// that has expired to the products' available stock.
+func ReleaseExpiredReservations(ctx context.Context, productCollection *mongo.Collection, reservationCollection *mongo.Collection) (int, error) {
+	filter := bson.D{primitive.E{Key: "expires_at", Value: bson.D{primitive.E{Key: "$lt", Value: time.Now()}}}}
+	cursor, err := reservationCollection.Find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	var expired []models.Reservation
+	if err = cursor.All(ctx, &expired); err != nil {
+		return 0, err
+	}
+
+	session, err := reservationCollection.Database().Client().StartSession()
+	if err != nil {
+		return 0, err
+	}
+	defer session.EndSession(ctx)
+
+	released := 0
+	for _, reservation := range expired {
+		done, err := session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+			// Delete only if it is still expired and unchanged, so a
+			// reservation refreshed or topped up in the meantime is left alone.
+			deleteFilter := bson.D{
+				primitive.E{Key: "_id", Value: reservation.Reservation_ID},
+				{Key: "quantity", Value: reservation.Quantity},
+				{Key: "expires_at", Value: bson.D{primitive.E{Key: "$lt", Value: time.Now()}}},
+			}
+			result, err := reservationCollection.DeleteOne(sc, deleteFilter)
+			if err != nil || result.DeletedCount == 0 {
+				return false, err
+			}
+
+			update := bson.D{{Key: "$inc", Value: bson.D{primitive.E{Key: "reserved", Value: -reservation.Quantity}}}}
+			if _, err = productCollection.UpdateOne(sc, bson.D{primitive.E{Key: "_id", Value: reservation.Product_ID}}, update); err != nil {
+				return false, err
+			}
+			return true, nil
+		})
+		if err != nil {
+			return released, err
+		}
+		if done.(bool) {
+			released++
+		}
+	}
+
+	return released, nil
+}
+
+// StartReservationReaper releases expired reservations every interval until
+// ctx is cancelled.
+func StartReservationReaper(ctx context.Context, productCollection *mongo.Collection, reservationCollection *mongo.Collection, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				runCtx, cancel := context.WithTimeout(ctx, interval)
+				released, err := ReleaseExpiredReservations(runCtx, productCollection, reservationCollection)
+				cancel()
+				if err != nil {
+					log.Println("reservation reaper:", err)
+				}
+				if released > 0 {
+					log.Printf("reservation reaper released %d reservations", released)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,184 @@
+package database
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/GadirB/ecommerce-go/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrLoginLocked = NewError(KindTooManyRequests, "login_locked", "too many failed login attempts, try again later")
+	ErrCantCheckLogin = NewError(KindInternal, "cant_check_login", "can't check login attempts")
+)
+
+// LoginThrottlePolicy limits failed logins. Once a counter passes Free
+// failures, each further failure locks it for Base_Lockout, doubling every
+// time up to Max_Lockout. Counters are forgotten Window after the last
+// failure.
+type LoginThrottlePolicy struct {
+	Free int
+	Base_Lockout time.Duration
+	Max_Lockout time.Duration
+	Window time.Duration
+}
+
+var (
+	// AccountThrottle guards a single account against password guessing.
+	AccountThrottle = LoginThrottlePolicy{Free: 5, Base_Lockout: 30 * time.Second, Max_Lockout: time.Hour, Window: 24 * time.Hour}
+	// AddressThrottle guards against one client trying many accounts.
+	AddressThrottle = LoginThrottlePolicy{Free: 20, Base_Lockout: time.Minute, Max_Lockout: 6 * time.Hour, Window: 24 * time.Hour}
+)
+
+func (p LoginThrottlePolicy) lockout(failures int) time.Duration {
+	over := failures - p.Free
+	if over <= 0 {
+		return 0
+	}
+	lockout := p.Base_Lockout
+	for i := 1; i < over && lockout < p.Max_Lockout; i++ {
+		lockout *= 2
+	}
+	if lockout > p.Max_Lockout {
+		lockout = p.Max_Lockout
+	}
+	return lockout
+}
+
+func LoginThrottleData(client *mongo.Client, collectionName string) *mongo.Collection{
+	var throttleCollection *mongo.Collection = client.Database("Ecommerce").Collection(collectionName)
+	return throttleCollection
+}
+
+// EnsureLoginThrottleIndexes creates the TTL index that forgets counters
+// once their window has passed.
+func EnsureLoginThrottleIndexes(ctx context.Context, throttleCollection *mongo.Collection) error {
+	_, err := throttleCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+func accountThrottleID(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func addressThrottleID(ip string) string {
+	return "ip:" + ip
+}
+
+// CheckLogin returns ErrLoginLocked, and how long until another attempt is
+// allowed, if either the account or the client address is locked out.
+// Unknown emails are throttled like real ones so the answer doesn't reveal
+// which accounts exist.
+func CheckLogin(ctx context.Context, throttleCollection *mongo.Collection, email string, ip string) (time.Duration, error) {
+	now := time.Now()
+	filter := bson.D{
+		primitive.E{Key: "_id", Value: bson.D{primitive.E{Key: "$in", Value: bson.A{accountThrottleID(email), addressThrottleID(ip)}}}},
+		{Key: "locked_until", Value: bson.D{primitive.E{Key: "$gt", Value: now}}},
+	}
+
+	cursor, err := throttleCollection.Find(ctx, filter)
+	if err != nil {
+		log.Println(err)
+		return 0, ErrCantCheckLogin
+	}
+
+	var locks []models.LoginThrottle
+	if err = cursor.All(ctx, &locks); err != nil {
+		log.Println(err)
+		return 0, ErrCantCheckLogin
+	}
+
+	var retryAfter time.Duration
+	for _, lock := range locks {
+		if wait := lock.Locked_Until.Sub(now); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	if retryAfter > 0 {
+		return retryAfter, ErrLoginLocked
+	}
+	return 0, nil
+}
+
+// RecordLoginFailure counts a failed login against the account and the
+// client address, locking either once it is over its policy's limit.
+func RecordLoginFailure(ctx context.Context, throttleCollection *mongo.Collection, email string, ip string) error {
+	if err := recordFailure(ctx, throttleCollection, accountThrottleID(email), AccountThrottle); err != nil {
+		return err
+	}
+	return recordFailure(ctx, throttleCollection, addressThrottleID(ip), AddressThrottle)
+}
+
+func recordFailure(ctx context.Context, throttleCollection *mongo.Collection, id string, policy LoginThrottlePolicy) error {
+	now := time.Now()
+
+	// The TTL monitor only runs once a minute, so counters past their
+	// window are dropped here before counting.
+	stale := bson.D{primitive.E{Key: "_id", Value: id}, {Key: "expires_at", Value: bson.D{primitive.E{Key: "$lte", Value: now}}}}
+	if _, err := throttleCollection.DeleteOne(ctx, stale); err != nil {
+		log.Println(err)
+		return ErrCantCheckLogin
+	}
+
+	update := bson.D{
+		{Key: "$inc", Value: bson.D{primitive.E{Key: "failures", Value: 1}}},
+		{Key: "$set", Value: bson.D{
+			primitive.E{Key: "last_failure_at", Value: now},
+			{Key: "expires_at", Value: now.Add(policy.Window)},
+		}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var throttle models.LoginThrottle
+	err := throttleCollection.FindOneAndUpdate(ctx, bson.D{primitive.E{Key: "_id", Value: id}}, update, opts).Decode(&throttle)
+	if err != nil {
+		log.Println(err)
+		return ErrCantCheckLogin
+	}
+
+	lockout := policy.lockout(throttle.Failures)
+	if lockout == 0 {
+		return nil
+	}
+
+	lockedUntil := now.Add(lockout)
+	expiresAt := lockedUntil
+	if windowEnd := now.Add(policy.Window); windowEnd.After(expiresAt) {
+		expiresAt = windowEnd
+	}
+	lock := bson.D{{Key: "$set", Value: bson.D{
+		primitive.E{Key: "locked_until", Value: lockedUntil},
+		{Key: "expires_at", Value: expiresAt},
+	}}}
+	if _, err = throttleCollection.UpdateOne(ctx, bson.D{primitive.E{Key: "_id", Value: id}}, lock); err != nil {
+		log.Println(err)
+		return ErrCantCheckLogin
+	}
+	return nil
+}
+
+// ClearLoginFailures resets the account's counter after a successful login.
+// The client address keeps its counter, so logging in to one account can't
+// be used to keep guessing at others.
+func ClearLoginFailures(ctx context.Context, throttleCollection *mongo.Collection, email string) error {
+	if _, err := throttleCollection.DeleteOne(ctx, bson.D{primitive.E{Key: "_id", Value: accountThrottleID(email)}}); err != nil {
+		log.Println(err)
+		return ErrCantCheckLogin
+	}
+	return nil
+}
+
+// UnlockAccount lifts a lockout and clears the failed login counter of an
+// account.
+func UnlockAccount(ctx context.Context, throttleCollection *mongo.Collection, email string) error {
+	return ClearLoginFailures(ctx, throttleCollection, email)
+}
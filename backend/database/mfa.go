@@ -0,0 +1,213 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/GadirB/ecommerce-go/totp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrMFAAlreadyEnabled = NewError(KindConflict, "mfa_already_enabled", "two-factor authentication is already enabled")
+	ErrMFANotEnabled = NewError(KindConflict, "mfa_not_enabled", "two-factor authentication is not enabled")
+	ErrMFANotEnrolling = NewError(KindConflict, "mfa_not_enrolling", "start two-factor enrollment first")
+	ErrInvalidMFACode = NewError(KindInvalid, "invalid_mfa_code", "the code is not valid")
+	ErrCantUpdateMFA = NewError(KindInternal, "cant_update_mfa", "can't update two-factor authentication")
+)
+
+// RecoveryCodeCount is how many recovery codes are handed out when 2FA is
+// turned on.
+const RecoveryCodeCount = 10
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// normalizeRecoveryCode lets users type codes in any case and with or
+// without the dash.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+func newRecoveryCodes() (codes []string, hashes []string, err error) {
+	for i := 0; i < RecoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		if _, err = rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(raw))
+		codes = append(codes, code[:4]+"-"+code[4:])
+		hashes = append(hashes, hashToken(normalizeRecoveryCode(code)))
+	}
+	return codes, hashes, nil
+}
+
+// StartMFAEnrollment gives the user a new secret to add to their
+// authenticator app. It only takes effect once ConfirmMFAEnrollment sees a
+// code generated from it.
+func StartMFAEnrollment(ctx context.Context, userCollection *mongo.Collection, userID string) (string, error) {
+	user, err := GetUser(ctx, userCollection, userID)
+	if err != nil {
+		return "", err
+	}
+	if user.MFA_Enabled {
+		return "", ErrMFAAlreadyEnabled
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		log.Println(err)
+		return "", ErrCantUpdateMFA
+	}
+
+	filter := bson.D{primitive.E{Key: "_id", Value: user.ID}, {Key: "mfa_enabled", Value: bson.D{primitive.E{Key: "$ne", Value: true}}}}
+	update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "mfa_pending_secret", Value: secret}}}}
+	result, err := userCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		log.Println(err)
+		return "", ErrCantUpdateMFA
+	}
+	if result.MatchedCount == 0 {
+		return "", ErrMFAAlreadyEnabled
+	}
+
+	return secret, nil
+}
+
+// ConfirmMFAEnrollment turns 2FA on once the user proves their app has the
+// pending secret, and returns the recovery codes. Only their hashes are
+// stored, so they can't be shown again.
+func ConfirmMFAEnrollment(ctx context.Context, userCollection *mongo.Collection, userID string, code string) ([]string, error) {
+	user, err := GetUser(ctx, userCollection, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.MFA_Enabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	if user.MFA_Pending_Secret == "" {
+		return nil, ErrMFANotEnrolling
+	}
+
+	step, ok := totp.Validate(user.MFA_Pending_Secret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		log.Println(err)
+		return nil, ErrCantUpdateMFA
+	}
+
+	filter := bson.D{
+		primitive.E{Key: "_id", Value: user.ID},
+		{Key: "mfa_pending_secret", Value: user.MFA_Pending_Secret},
+		{Key: "mfa_enabled", Value: bson.D{primitive.E{Key: "$ne", Value: true}}},
+	}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			primitive.E{Key: "mfa_enabled", Value: true},
+			{Key: "mfa_secret", Value: user.MFA_Pending_Secret},
+			{Key: "mfa_last_step", Value: step},
+			{Key: "mfa_recovery_codes", Value: hashes},
+			{Key: "updated_at", Value: time.Now()},
+		}},
+		{Key: "$unset", Value: bson.D{primitive.E{Key: "mfa_pending_secret", Value: ""}}},
+	}
+	result, err := userCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrCantUpdateMFA
+	}
+	if result.MatchedCount == 0 {
+		return nil, ErrMFANotEnrolling
+	}
+
+	return codes, nil
+}
+
+// VerifyMFACode checks a code from the user's authenticator app. Each code
+// is accepted once: the step it belongs to is recorded and codes from that
+// step or earlier are refused afterwards.
+func VerifyMFACode(ctx context.Context, userCollection *mongo.Collection, userID string, code string) error {
+	user, err := GetUser(ctx, userCollection, userID)
+	if err != nil {
+		return err
+	}
+	if !user.MFA_Enabled {
+		return ErrMFANotEnabled
+	}
+
+	step, ok := totp.Validate(user.MFA_Secret, code, time.Now())
+	if !ok || step <= user.MFA_Last_Step {
+		return ErrInvalidMFACode
+	}
+
+	filter := bson.D{primitive.E{Key: "_id", Value: user.ID}, {Key: "mfa_last_step", Value: bson.D{primitive.E{Key: "$lt", Value: step}}}}
+	update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "mfa_last_step", Value: step}}}}
+	result, err := userCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		log.Println(err)
+		return ErrCantUpdateMFA
+	}
+	if result.MatchedCount == 0 {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// UseRecoveryCode accepts one of the user's recovery codes in place of an
+// app code and removes it, so each works once.
+func UseRecoveryCode(ctx context.Context, userCollection *mongo.Collection, userID string, code string) error {
+	user, err := GetUser(ctx, userCollection, userID)
+	if err != nil {
+		return err
+	}
+	if !user.MFA_Enabled {
+		return ErrMFANotEnabled
+	}
+
+	hash := hashToken(normalizeRecoveryCode(code))
+	filter := bson.D{primitive.E{Key: "_id", Value: user.ID}, {Key: "mfa_recovery_codes", Value: hash}}
+	update := bson.D{{Key: "$pull", Value: bson.D{primitive.E{Key: "mfa_recovery_codes", Value: hash}}}}
+	result, err := userCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		log.Println(err)
+		return ErrCantUpdateMFA
+	}
+	if result.ModifiedCount == 0 {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// DisableMFA turns 2FA off and forgets the secret and recovery codes.
+func DisableMFA(ctx context.Context, userCollection *mongo.Collection, userID string) error {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return ErrUserIdIsNotValid
+	}
+
+	update := bson.D{
+		{Key: "$set", Value: bson.D{primitive.E{Key: "mfa_enabled", Value: false}, {Key: "updated_at", Value: time.Now()}}},
+		{Key: "$unset", Value: bson.D{
+			primitive.E{Key: "mfa_secret", Value: ""},
+			{Key: "mfa_pending_secret", Value: ""},
+			{Key: "mfa_last_step", Value: ""},
+			{Key: "mfa_recovery_codes", Value: ""},
+		}},
+	}
+	if _, err = userCollection.UpdateOne(ctx, bson.D{primitive.E{Key: "_id", Value: id}}, update); err != nil {
+		log.Println(err)
+		return ErrCantUpdateMFA
+	}
+	return nil
+}
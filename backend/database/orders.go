@@ -0,0 +1,144 @@
+package database
+
+import (
+	"context"
+	"log"
+
+	"github.com/GadirB/ecommerce-go/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrCantFindOrder = NewError(KindNotFound, "order_not_found", "can't find order")
+	ErrCantListOrders = NewError(KindInternal, "cant_list_orders", "can't list orders")
+)
+
+// EnsureOrderIndexes creates the index backing the per-user, newest-first
+// order listing.
+func EnsureOrderIndexes(ctx context.Context, orderCollection *mongo.Collection) error {
+	_, err := orderCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "ordered_at", Value: -1}},
+	})
+	return err
+}
+
+// ListUserOrders returns one page of the user's orders, newest first, along
+// with the total number of orders the user has placed.
+func ListUserOrders(ctx context.Context, orderCollection *mongo.Collection, userID string, page int64, perPage int64) ([]models.Order, int64, error) {
+	if _, err := primitive.ObjectIDFromHex(userID); err != nil {
+		log.Println(err)
+		return nil, 0, ErrUserIdIsNotValid
+	}
+
+	filter := bson.D{primitive.E{Key: "user_id", Value: userID}}
+
+	total, err := orderCollection.CountDocuments(ctx, filter)
+	if err != nil {
+		log.Println(err)
+		return nil, 0, ErrCantListOrders
+	}
+
+	orders := make([]models.Order, 0)
+	if total == 0 {
+		return orders, 0, nil
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "ordered_at", Value: -1}}).
+		SetSkip((page - 1) * perPage).
+		SetLimit(perPage)
+
+	cursor, err := orderCollection.Find(ctx, filter, opts)
+	if err != nil {
+		log.Println(err)
+		return nil, 0, ErrCantListOrders
+	}
+
+	if err = cursor.All(ctx, &orders); err != nil {
+		log.Println(err)
+		return nil, 0, ErrCantListOrders
+	}
+
+	return orders, total, nil
+}
+
+// GetUserOrder looks up a single order, but only among the given user's orders.
+func GetUserOrder(ctx context.Context, orderCollection *mongo.Collection, userID string, orderID primitive.ObjectID) (models.Order, error) {
+	var order models.Order
+
+	if _, err := primitive.ObjectIDFromHex(userID); err != nil {
+		log.Println(err)
+		return order, ErrUserIdIsNotValid
+	}
+
+	filter := bson.D{primitive.E{Key: "_id", Value: orderID}, {Key: "user_id", Value: userID}}
+	err := orderCollection.FindOne(ctx, filter).Decode(&order)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Println(err)
+		}
+		return order, ErrCantFindOrder
+	}
+
+	return order, nil
+}
+
+// MigrateEmbeddedOrders moves orders still stored in the legacy Users.orders
+// array into the Orders collection. Each user is migrated in its own
+// transaction, so a failure never leaves a user's orders half moved and a
+// rerun picks up where the previous one stopped.
+func MigrateEmbeddedOrders(ctx context.Context, userCollection *mongo.Collection, orderCollection *mongo.Collection) error {
+	filter := bson.D{primitive.E{Key: "orders", Value: bson.D{primitive.E{Key: "$exists", Value: true}}}}
+	cursor, err := userCollection.Find(ctx, filter, options.Find().SetProjection(bson.D{{Key: "orders", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	session, err := userCollection.Database().Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	for cursor.Next(ctx) {
+		var legacy struct {
+			ID primitive.ObjectID `bson:"_id"`
+			Orders []models.Order `bson:"orders"`
+		}
+		if err := cursor.Decode(&legacy); err != nil {
+			return err
+		}
+
+		_, err := session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+			for _, order := range legacy.Orders {
+				order.User_ID = legacy.ID.Hex()
+				if order.Order_Cart == nil {
+					order.Order_Cart = make([]models.ProductUser, 0)
+				}
+				if order.Status == "" {
+					order.Status = models.OrderPending
+				}
+				if order.Status_History == nil {
+					order.Status_History = make([]models.StatusChange, 0)
+				}
+				if _, err := orderCollection.InsertOne(sc, order); err != nil {
+					return nil, err
+				}
+			}
+
+			update := bson.D{{Key: "$unset", Value: bson.D{primitive.E{Key: "orders", Value: ""}}}}
+			return userCollection.UpdateOne(sc, bson.D{primitive.E{Key: "_id", Value: legacy.ID}}, update)
+		})
+		if err != nil {
+			return err
+		}
+
+		log.Printf("migrated %d orders for user %s", len(legacy.Orders), legacy.ID.Hex())
+	}
+
+	return cursor.Err()
+}
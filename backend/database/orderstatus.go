@@ -0,0 +1,206 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/GadirB/ecommerce-go/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrUnknownOrderStatus = NewError(KindInvalid, "unknown_order_status", "unknown order status")
+	ErrOrderStatusChanged = NewError(KindConflict, "order_status_changed", "order status was changed by another request")
+	ErrCantUpdateOrder = NewError(KindInternal, "cant_update_order", "can't update order")
+	ErrInvalidTransition = NewError(KindConflict, "invalid_transition", "order can't move to that status")
+)
+
+// InvalidTransitionError is returned when an order is asked to move to a
+// status that is not reachable from the one it is currently in.
+type InvalidTransitionError struct {
+	From models.OrderStatus
+	To models.OrderStatus
+}
+
+func (e *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("order can't move from %q to %q", e.From, e.To)
+}
+
+func (e *InvalidTransitionError) Unwrap() error {
+	return ErrInvalidTransition
+}
+
+func (e *InvalidTransitionError) Details() interface{} {
+	return map[string]models.OrderStatus{"from": e.From, "to": e.To}
+}
+
+// orderTransitions is the order lifecycle: every status maps to the statuses
+// it may move to next. Cancelled and refunded are terminal.
+var orderTransitions = map[models.OrderStatus][]models.OrderStatus{
+	models.OrderPending: {models.OrderPaid, models.OrderCancelled},
+	models.OrderPaid: {models.OrderPacked, models.OrderCancelled, models.OrderRefunded},
+	models.OrderPacked: {models.OrderShipped, models.OrderCancelled, models.OrderRefunded},
+	models.OrderShipped: {models.OrderDelivered},
+	models.OrderDelivered: {models.OrderRefunded},
+	models.OrderCancelled: {},
+	models.OrderRefunded: {},
+}
+
+// restockingStatuses give the order's units back to stock when an order
+// moves to them.
+var restockingStatuses = map[models.OrderStatus]bool{
+	models.OrderCancelled: true,
+	models.OrderRefunded: true,
+}
+
+// customerTransitions are the target statuses a customer may request on
+// their own orders; everything else is driven by staff.
+var customerTransitions = map[models.OrderStatus]bool{
+	models.OrderCancelled: true,
+}
+
+func IsKnownOrderStatus(status models.OrderStatus) bool {
+	_, ok := orderTransitions[status]
+	return ok
+}
+
+func CanTransition(from models.OrderStatus, to models.OrderStatus) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// currentStatus treats orders written before statuses existed as pending.
+func currentStatus(order models.Order) models.OrderStatus {
+	if order.Status == "" {
+		return models.OrderPending
+	}
+	return order.Status
+}
+
+// NewOrderHistory returns the opening history entry for a freshly placed order.
+func NewOrderHistory(actor string, at time.Time) []models.StatusChange {
+	return []models.StatusChange{{
+		To: models.OrderPending,
+		Changed_At: at,
+		Changed_By: actor,
+	}}
+}
+
+// TransitionUserOrder moves one of the user's own orders to a new status.
+// Customers may only request the transitions listed in customerTransitions.
+func TransitionUserOrder(ctx context.Context, orderCollection *mongo.Collection, productCollection *mongo.Collection, userID string, orderID primitive.ObjectID, to models.OrderStatus, note string) (models.Order, error) {
+	if !customerTransitions[to] {
+		order, err := GetUserOrder(ctx, orderCollection, userID, orderID)
+		if err != nil {
+			return order, err
+		}
+		return order, &InvalidTransitionError{From: currentStatus(order), To: to}
+	}
+
+	if _, err := primitive.ObjectIDFromHex(userID); err != nil {
+		log.Println(err)
+		return models.Order{}, ErrUserIdIsNotValid
+	}
+
+	owner := bson.D{primitive.E{Key: "_id", Value: orderID}, {Key: "user_id", Value: userID}}
+	return transitionOrder(ctx, orderCollection, productCollection, owner, to, userID, note)
+}
+
+// TransitionOrder moves any order to a new status on behalf of staff.
+func TransitionOrder(ctx context.Context, orderCollection *mongo.Collection, productCollection *mongo.Collection, orderID primitive.ObjectID, to models.OrderStatus, actor string, note string) (models.Order, error) {
+	return transitionOrder(ctx, orderCollection, productCollection, bson.D{primitive.E{Key: "_id", Value: orderID}}, to, actor, note)
+}
+
+// restockOrder gives the units of every line of the order back to stock.
+func restockOrder(sc mongo.SessionContext, productCollection *mongo.Collection, order models.Order) error {
+	for _, item := range order.Order_Cart {
+		quantity := item.Quantity
+		if quantity < 1 {
+			quantity = 1
+		}
+		update := bson.D{{Key: "$inc", Value: bson.D{primitive.E{Key: "stock", Value: quantity}}}}
+		if _, err := productCollection.UpdateOne(sc, bson.D{primitive.E{Key: "_id", Value: item.Product_ID}}, update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transitionOrder moves the order matched by filter to a new status. When
+// it is cancelled or refunded, its units go back to stock in the same
+// transaction as the status change.
+func transitionOrder(ctx context.Context, orderCollection *mongo.Collection, productCollection *mongo.Collection, filter bson.D, to models.OrderStatus, actor string, note string) (models.Order, error) {
+	var order models.Order
+
+	if !IsKnownOrderStatus(to) {
+		return order, ErrUnknownOrderStatus
+	}
+
+	err := orderCollection.FindOne(ctx, filter).Decode(&order)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Println(err)
+		}
+		return order, ErrCantFindOrder
+	}
+
+	from := currentStatus(order)
+	if !CanTransition(from, to) {
+		return order, &InvalidTransitionError{From: from, To: to}
+	}
+
+	change := models.StatusChange{
+		From: from,
+		To: to,
+		Changed_At: time.Now(),
+		Changed_By: actor,
+		Note: note,
+	}
+
+	// Only write if the order is still in the status we validated against, so
+	// two concurrent transitions can't both succeed.
+	var statusMatch interface{} = from
+	if from == models.OrderPending {
+		statusMatch = bson.D{primitive.E{Key: "$in", Value: bson.A{from, nil}}}
+	}
+
+	guarded := bson.D{primitive.E{Key: "_id", Value: order.Order_ID}, {Key: "status", Value: statusMatch}}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{primitive.E{Key: "status", Value: to}}},
+		{Key: "$push", Value: bson.D{primitive.E{Key: "status_history", Value: change}}},
+	}
+
+	_, err = runInTransaction(ctx, orderCollection, func(sc mongo.SessionContext) (interface{}, error) {
+		result, err := orderCollection.UpdateOne(sc, guarded, update)
+		if err != nil {
+			return nil, err
+		}
+		if result.MatchedCount == 0 {
+			return nil, ErrOrderStatusChanged
+		}
+		if restockingStatuses[to] {
+			return nil, restockOrder(sc, productCollection, order)
+		}
+		return nil, nil
+	})
+	if errors.Is(err, ErrOrderStatusChanged) {
+		return order, err
+	}
+	if err != nil {
+		log.Println(err)
+		return order, ErrCantUpdateOrder
+	}
+
+	order.Status = to
+	order.Status_History = append(order.Status_History, change)
+	return order, nil
+}
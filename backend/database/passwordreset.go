@@ -0,0 +1,143 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/GadirB/ecommerce-go/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrCantCreateReset = NewError(KindInternal, "cant_create_reset", "can't create password reset")
+	ErrResetTokenInvalid = NewError(KindInvalid, "reset_token_invalid", "reset token is invalid or has expired")
+	ErrCantUpdatePassword = NewError(KindInternal, "cant_update_password", "can't update password")
+)
+
+// PasswordResetTTL is how long a reset token stays usable.
+var PasswordResetTTL = time.Hour
+
+func PasswordResetData(client *mongo.Client, collectionName string) *mongo.Collection{
+	var resetCollection *mongo.Collection = client.Database("Ecommerce").Collection(collectionName)
+	return resetCollection
+}
+
+// EnsurePasswordResetIndexes creates the token lookup index and a TTL index
+// that drops resets once they have expired.
+func EnsurePasswordResetIndexes(ctx context.Context, resetCollection *mongo.Collection) error {
+	_, err := resetCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{
+			Keys: bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+// newOpaqueToken returns a random token to hand to the user and the hash to
+// store in its place.
+func newOpaqueToken() (token string, hash string, err error) {
+	raw := make([]byte, 32)
+	if _, err = rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(raw)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreatePasswordReset starts a reset for the user and returns the token to
+// mail them. Resets started earlier and not used yet stop working.
+func CreatePasswordReset(ctx context.Context, resetCollection *mongo.Collection, userID string) (string, error) {
+	token, tokenHash, err := newOpaqueToken()
+	if err != nil {
+		log.Println(err)
+		return "", ErrCantCreateReset
+	}
+
+	_, err = resetCollection.DeleteMany(ctx, bson.D{primitive.E{Key: "user_id", Value: userID}, {Key: "used_at", Value: nil}})
+	if err != nil {
+		log.Println(err)
+		return "", ErrCantCreateReset
+	}
+
+	now := time.Now()
+	_, err = resetCollection.InsertOne(ctx, models.PasswordReset{
+		Reset_ID: primitive.NewObjectID(),
+		User_ID: userID,
+		Token_Hash: tokenHash,
+		Created_At: now,
+		Expires_At: now.Add(PasswordResetTTL),
+	})
+	if err != nil {
+		log.Println(err)
+		return "", ErrCantCreateReset
+	}
+
+	return token, nil
+}
+
+// ConsumePasswordReset marks the reset for the token used and returns the
+// user it was issued to. A token works once and only until it expires.
+func ConsumePasswordReset(ctx context.Context, resetCollection *mongo.Collection, token string) (string, error) {
+	now := time.Now()
+	filter := bson.D{
+		primitive.E{Key: "token_hash", Value: hashToken(token)},
+		{Key: "used_at", Value: nil},
+		{Key: "expires_at", Value: bson.D{primitive.E{Key: "$gt", Value: now}}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "used_at", Value: now}}}}
+
+	var reset models.PasswordReset
+	err := resetCollection.FindOneAndUpdate(ctx, filter, update).Decode(&reset)
+	if err == mongo.ErrNoDocuments {
+		return "", ErrResetTokenInvalid
+	}
+	if err != nil {
+		log.Println(err)
+		return "", ErrCantUpdatePassword
+	}
+
+	return reset.User_ID, nil
+}
+
+// SetUserPassword stores a new password hash for the user.
+func SetUserPassword(ctx context.Context, userCollection *mongo.Collection, userID string, passwordHash string) error {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return ErrUserIdIsNotValid
+	}
+
+	filter := bson.D{primitive.E{Key: "_id", Value: id}}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		primitive.E{Key: "password", Value: passwordHash},
+		{Key: "updated_at", Value: time.Now()},
+	}}}
+
+	result, err := userCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		log.Println(err)
+		return ErrCantUpdatePassword
+	}
+	if result.MatchedCount == 0 {
+		return ErrCantUpdatePassword
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package database
+
+import (
+	"context"
+	"log"
+
+	"github.com/GadirB/ecommerce-go/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var ErrCantPriceCart = NewError(KindInternal, "cant_price_cart", "can't price the cart")
+
+// PricedLine is one product in a priced cart. Cart entries for the same
+// product are folded into a single line and their quantities summed.
+type PricedLine struct {
+	Product_ID primitive.ObjectID `json:"product_id" bson:"product_id"`
+	Product_Name *string `json:"product_name" bson:"product_name"`
+	Unit_Price int `json:"unit_price" bson:"unit_price"`
+	Quantity int `json:"quantity" bson:"quantity"`
+	Line_Total int `json:"line_total" bson:"line_total"`
+}
+
+// CartPricing is the full price breakdown of a single user's cart.
+type CartPricing struct {
+	Lines []PricedLine `json:"lines" bson:"lines"`
+	Item_Count int `json:"item_count" bson:"item_count"`
+	Subtotal int `json:"subtotal" bson:"subtotal"`
+	Discount int `json:"discount" bson:"discount"`
+	Total int `json:"total" bson:"total"`
+}
+
+// DiscountRule returns the discount that applies to a priced cart, in the
+// same units as product prices.
+type DiscountRule func(lines []PricedLine, subtotal int) int
+
+// CheckoutDiscounts are applied, in order, to every cart that is priced. main
+// sets them from the DISCOUNT_* variables.
+var CheckoutDiscounts []DiscountRule
+
+// SpendDiscount takes percent off carts whose subtotal is at least
+// minSubtotal, rounding the discount down.
+func SpendDiscount(minSubtotal int, percent int) DiscountRule {
+	return func(lines []PricedLine, subtotal int) int {
+		if subtotal < minSubtotal {
+			return 0
+		}
+		return subtotal * percent / 100
+	}
+}
+
+// PriceCart prices the given cart items at the products' current prices. It
+// only ever looks at the items it is handed, so callers must pass the cart of
+// the user being charged.
+func PriceCart(ctx context.Context, productCollection *mongo.Collection, items []models.ProductUser) (CartPricing, error) {
+	pricing := CartPricing{Lines: make([]PricedLine, 0, len(items))}
+	lineIndex := make(map[primitive.ObjectID]int, len(items))
+
+	for _, item := range items {
+		quantity := item.Quantity
+		if quantity < 1 {
+			quantity = 1
+		}
+		if i, ok := lineIndex[item.Product_ID]; ok {
+			pricing.Lines[i].Quantity += quantity
+			continue
+		}
+		lineIndex[item.Product_ID] = len(pricing.Lines)
+		pricing.Lines = append(pricing.Lines, PricedLine{
+			Product_ID: item.Product_ID,
+			Product_Name: item.Product_Name,
+			Quantity: quantity,
+		})
+	}
+
+	if len(pricing.Lines) > 0 {
+		ids := make(bson.A, 0, len(pricing.Lines))
+		for _, line := range pricing.Lines {
+			ids = append(ids, line.Product_ID)
+		}
+		filter := bson.D{primitive.E{Key: "_id", Value: bson.D{primitive.E{Key: "$in", Value: ids}}}}
+		cursor, err := productCollection.Find(ctx, filter)
+		if err != nil {
+			log.Println(err)
+			return pricing, ErrCantPriceCart
+		}
+		var products []models.Product
+		if err := cursor.All(ctx, &products); err != nil {
+			log.Println(err)
+			return pricing, ErrCantPriceCart
+		}
+
+		priced := 0
+		for _, product := range products {
+			i, ok := lineIndex[product.Product_ID]
+			if !ok || product.Price == nil {
+				continue
+			}
+			pricing.Lines[i].Unit_Price = int(*product.Price)
+			if product.Product_Name != nil {
+				pricing.Lines[i].Product_Name = product.Product_Name
+			}
+			priced++
+		}
+		if priced < len(pricing.Lines) {
+			return pricing, ErrCantFindProduct
+		}
+	}
+
+	for i := range pricing.Lines {
+		line := &pricing.Lines[i]
+		line.Line_Total = line.Unit_Price * line.Quantity
+		pricing.Item_Count += line.Quantity
+		pricing.Subtotal += line.Line_Total
+	}
+
+	for _, rule := range CheckoutDiscounts {
+		if discount := rule(pricing.Lines, pricing.Subtotal); discount > 0 {
+			pricing.Discount += discount
+		}
+	}
+	if pricing.Discount > pricing.Subtotal {
+		pricing.Discount = pricing.Subtotal
+	}
+
+	pricing.Total = pricing.Subtotal - pricing.Discount
+	return pricing, nil
+}
+
+// Reprice returns a copy of items at the unit prices they were priced at,
+// for storing with an order.
+func (p CartPricing) Reprice(items []models.ProductUser) []models.ProductUser {
+	prices := make(map[primitive.ObjectID]int, len(p.Lines))
+	for _, line := range p.Lines {
+		prices[line.Product_ID] = line.Unit_Price
+	}
+	repriced := make([]models.ProductUser, 0, len(items))
+	for _, item := range items {
+		if price, ok := prices[item.Product_ID]; ok {
+			item.Price = price
+		}
+		repriced = append(repriced, item)
+	}
+	return repriced
+}
+
+// GetCart returns the items in the user's cart and their pricing.
+func GetCart(ctx context.Context, userCollection *mongo.Collection, productCollection *mongo.Collection, userID string) ([]models.ProductUser, CartPricing, error) {
+	user, err := GetUser(ctx, userCollection, userID)
+	if err != nil {
+		return nil, CartPricing{}, err
+	}
+	pricing, err := PriceCart(ctx, productCollection, user.UserCart)
+	if err != nil {
+		return nil, pricing, err
+	}
+	return pricing.Reprice(user.UserCart), pricing, nil
+}
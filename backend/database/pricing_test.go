@@ -0,0 +1,163 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/GadirB/ecommerce-go/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func cartLine(productID primitive.ObjectID, price int, quantity int) bson.D {
+	return bson.D{
+		{Key: "_id", Value: productID},
+		{Key: "product_name", Value: "snapshot"},
+		{Key: "price", Value: price},
+		{Key: "quantity", Value: quantity},
+	}
+}
+
+func product(productID primitive.ObjectID, name string, price int64) bson.D {
+	return bson.D{
+		{Key: "_id", Value: productID},
+		{Key: "product_name", Value: name},
+		{Key: "price", Value: price},
+	}
+}
+
+func TestPriceCartUsesCurrentPrices(t *testing.T) {
+	server, client := newStandIn(t)
+	products := ProductData(client, "Products")
+
+	lamp, desk := primitive.NewObjectID(), primitive.NewObjectID()
+	server.insert(t, "Products", product(lamp, "Lamp", 150), product(desk, "Desk", 40))
+
+	var cart []models.ProductUser
+	for _, line := range []bson.D{cartLine(lamp, 100, 2), cartLine(desk, 10, 1), cartLine(lamp, 100, 1)} {
+		var item models.ProductUser
+		data, _ := bson.Marshal(line)
+		if err := bson.Unmarshal(data, &item); err != nil {
+			t.Fatal(err)
+		}
+		cart = append(cart, item)
+	}
+
+	pricing, err := PriceCart(context.Background(), products, cart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pricing.Lines) != 2 {
+		t.Fatalf("got %d lines, want 2", len(pricing.Lines))
+	}
+	if line := pricing.Lines[0]; line.Unit_Price != 150 || line.Quantity != 3 || line.Line_Total != 450 || *line.Product_Name != "Lamp" {
+		t.Errorf("lamp line = %+v, want 3 at the current price of 150", line)
+	}
+	if line := pricing.Lines[1]; line.Unit_Price != 40 || line.Line_Total != 40 {
+		t.Errorf("desk line = %+v, want 1 at the current price of 40", line)
+	}
+	if pricing.Subtotal != 490 || pricing.Item_Count != 4 || pricing.Discount != 0 || pricing.Total != 490 {
+		t.Errorf("pricing = %+v, want subtotal and total 490 for 4 items", pricing)
+	}
+
+	repriced := pricing.Reprice(cart)
+	if repriced[0].Price != 150 || repriced[1].Price != 40 || cart[0].Price != 100 {
+		t.Errorf("Reprice gave %d and %d and changed the cart to %d", repriced[0].Price, repriced[1].Price, cart[0].Price)
+	}
+}
+
+func TestPriceCartAppliesDiscounts(t *testing.T) {
+	server, client := newStandIn(t)
+	products := ProductData(client, "Products")
+
+	chair := primitive.NewObjectID()
+	server.insert(t, "Products", product(chair, "Chair", 75))
+
+	defer func(rules []DiscountRule) { CheckoutDiscounts = rules }(CheckoutDiscounts)
+	CheckoutDiscounts = []DiscountRule{SpendDiscount(200, 10)}
+
+	tests := []struct {
+		quantity int
+		discount int
+		total int
+	}{
+		{quantity: 2, discount: 0, total: 150},
+		{quantity: 3, discount: 22, total: 203},
+		{quantity: 4, discount: 30, total: 270},
+	}
+	for _, test := range tests {
+		cart := []models.ProductUser{{Product_ID: chair, Quantity: test.quantity}}
+		pricing, err := PriceCart(context.Background(), products, cart)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pricing.Discount != test.discount || pricing.Total != test.total {
+			t.Errorf("%d chairs: discount %d total %d, want %d and %d", test.quantity, pricing.Discount, pricing.Total, test.discount, test.total)
+		}
+	}
+}
+
+func TestPriceCartMissingProduct(t *testing.T) {
+	_, client := newStandIn(t)
+
+	cart := []models.ProductUser{{Product_ID: primitive.NewObjectID(), Quantity: 1}}
+	_, err := PriceCart(context.Background(), ProductData(client, "Products"), cart)
+	if !errors.Is(err, ErrCantFindProduct) {
+		t.Fatalf("got %v, want ErrCantFindProduct", err)
+	}
+}
+
+// Checkout used to price the cart from an aggregation over every user, so
+// one customer could be charged another's total. Each user must only ever
+// get their own.
+func TestGetCartConcurrentUsers(t *testing.T) {
+	server, client := newStandIn(t)
+	users := UserData(client, "Users")
+	products := ProductData(client, "Products")
+
+	cheap, dear := primitive.NewObjectID(), primitive.NewObjectID()
+	server.insert(t, "Products", product(cheap, "Pen", 3), product(dear, "Watch", 900))
+
+	alice, bob := primitive.NewObjectID(), primitive.NewObjectID()
+	server.insert(t, "Users",
+		bson.D{{Key: "_id", Value: alice}, {Key: "usercart", Value: bson.A{cartLine(cheap, 3, 4)}}},
+		bson.D{{Key: "_id", Value: bob}, {Key: "usercart", Value: bson.A{cartLine(dear, 900, 1), cartLine(cheap, 3, 1)}}},
+	)
+
+	want := map[primitive.ObjectID]int{alice: 12, bob: 903}
+
+	const rounds = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*rounds)
+	for i := 0; i < rounds; i++ {
+		for userID, total := range want {
+			wg.Add(1)
+			go func(userID primitive.ObjectID, total int) {
+				defer wg.Done()
+				_, pricing, err := GetCart(context.Background(), users, products, userID.Hex())
+				if err != nil {
+					errs <- err
+					return
+				}
+				if pricing.Total != total {
+					errs <- fmt.Errorf("user %s got total %d, want %d", userID.Hex(), pricing.Total, total)
+				}
+			}(userID, total)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for _, filter := range server.findFilters("Users") {
+		if _, ok := filter.Lookup("_id").ObjectIDOK(); !ok {
+			t.Errorf("users were read with filter %v, not by the caller's id", filter)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package database
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/GadirB/ecommerce-go/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrCantCreateProduct = NewError(KindInternal, "cant_create_product", "can't create product")
+	ErrCantListProducts = NewError(KindInternal, "cant_list_products", "can't list products")
+	ErrProductIsDeleted = NewError(KindConflict, "product_deleted", "product is deleted")
+	ErrProductNotDeleted = NewError(KindConflict, "product_not_deleted", "product is not deleted")
+)
+
+// Values accepted by ProductFilter.Deleted.
+const (
+	DeletedExclude = "exclude"
+	DeletedOnly = "only"
+	DeletedInclude = "include"
+)
+
+// NotDeleted matches products that haven't been soft-deleted.
+var NotDeleted = bson.E{Key: "deleted_at", Value: nil}
+
+// ProductFilter narrows the admin product listing. Zero values mean no
+// constraint, except Deleted which defaults to hiding deleted products.
+type ProductFilter struct {
+	Name string
+	Min_Price *uint64
+	Max_Price *uint64
+	Min_Rating *uint8
+	Deleted string
+}
+
+func (f ProductFilter) query() bson.D {
+	query := bson.D{}
+
+	if f.Name != "" {
+		pattern := regexp.QuoteMeta(f.Name)
+		query = append(query, bson.E{Key: "product_name", Value: primitive.Regex{Pattern: pattern, Options: "i"}})
+	}
+
+	price := bson.D{}
+	if f.Min_Price != nil {
+		price = append(price, bson.E{Key: "$gte", Value: *f.Min_Price})
+	}
+	if f.Max_Price != nil {
+		price = append(price, bson.E{Key: "$lte", Value: *f.Max_Price})
+	}
+	if len(price) > 0 {
+		query = append(query, bson.E{Key: "price", Value: price})
+	}
+
+	if f.Min_Rating != nil {
+		query = append(query, bson.E{Key: "rating", Value: bson.D{primitive.E{Key: "$gte", Value: *f.Min_Rating}}})
+	}
+
+	switch f.Deleted {
+	case DeletedOnly:
+		query = append(query, bson.E{Key: "deleted_at", Value: bson.D{primitive.E{Key: "$ne", Value: nil}}})
+	case DeletedInclude:
+	default:
+		query = append(query, NotDeleted)
+	}
+
+	return query
+}
+
+func CreateProduct(ctx context.Context, productCollection *mongo.Collection, product *models.Product) error {
+	now := time.Now()
+	product.Product_ID = primitive.NewObjectID()
+	product.Reserved = 0
+	product.Created_At = now
+	product.Updated_At = now
+	product.Deleted_At = nil
+	if product.Product_Name != nil {
+		product.Search_Terms = SearchTerms(*product.Product_Name)
+	}
+
+	if _, err := productCollection.InsertOne(ctx, product); err != nil {
+		log.Println(err)
+		return ErrCantCreateProduct
+	}
+	return nil
+}
+
+func GetProduct(ctx context.Context, productCollection *mongo.Collection, productID primitive.ObjectID) (models.Product, error) {
+	var product models.Product
+	err := productCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: productID}}).Decode(&product)
+	if err == mongo.ErrNoDocuments {
+		return product, ErrCantFindProduct
+	}
+	if err != nil {
+		log.Println(err)
+		return product, ErrCantDecodeProducts
+	}
+	return product, nil
+}
+
+// UpdateProduct sets the given fields on a product that isn't deleted. When
+// stock is among them, the update only applies if it still covers the units
+// reserved in carts; a new name also updates the search terms.
+func UpdateProduct(ctx context.Context, productCollection *mongo.Collection, productID primitive.ObjectID, fields bson.D) (models.Product, error) {
+	filter := bson.D{primitive.E{Key: "_id", Value: productID}, NotDeleted}
+	for _, field := range fields {
+		if field.Key == "stock" {
+			filter = append(filter, bson.E{Key: "reserved", Value: bson.D{primitive.E{Key: "$lte", Value: field.Value}}})
+		}
+		if field.Key == "product_name" {
+			switch name := field.Value.(type) {
+			case string:
+				fields = append(fields, bson.E{Key: searchTermsField, Value: SearchTerms(name)})
+			case *string:
+				if name != nil {
+					fields = append(fields, bson.E{Key: searchTermsField, Value: SearchTerms(*name)})
+				}
+			}
+		}
+	}
+
+	fields = append(fields, bson.E{Key: "updated_at", Value: time.Now()})
+	update := bson.D{{Key: "$set", Value: fields}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var product models.Product
+	err := productCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&product)
+	if err == mongo.ErrNoDocuments {
+		current, getErr := GetProduct(ctx, productCollection, productID)
+		switch {
+		case getErr != nil:
+			return product, getErr
+		case current.Deleted_At != nil:
+			return product, ErrProductIsDeleted
+		default:
+			return product, ErrStockBelowReserved
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		return product, ErrCantUpdateProduct
+	}
+
+	return product, nil
+}
+
+// SoftDeleteProduct hides a product from the catalog and from checkout
+// without removing it, so past orders and carts still resolve.
+func SoftDeleteProduct(ctx context.Context, productCollection *mongo.Collection, productID primitive.ObjectID) error {
+	now := time.Now()
+	filter := bson.D{primitive.E{Key: "_id", Value: productID}, NotDeleted}
+	update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "deleted_at", Value: now}, {Key: "updated_at", Value: now}}}}
+	return setDeleted(ctx, productCollection, productID, filter, update, ErrProductIsDeleted)
+}
+
+func RestoreProduct(ctx context.Context, productCollection *mongo.Collection, productID primitive.ObjectID) error {
+	filter := bson.D{primitive.E{Key: "_id", Value: productID}, {Key: "deleted_at", Value: bson.D{primitive.E{Key: "$ne", Value: nil}}}}
+	update := bson.D{
+		{Key: "$unset", Value: bson.D{primitive.E{Key: "deleted_at", Value: ""}}},
+		{Key: "$set", Value: bson.D{primitive.E{Key: "updated_at", Value: time.Now()}}},
+	}
+	return setDeleted(ctx, productCollection, productID, filter, update, ErrProductNotDeleted)
+}
+
+func setDeleted(ctx context.Context, productCollection *mongo.Collection, productID primitive.ObjectID, filter bson.D, update bson.D, alreadyErr error) error {
+	result, err := productCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		log.Println(err)
+		return ErrCantUpdateProduct
+	}
+	if result.MatchedCount > 0 {
+		return nil
+	}
+
+	count, err := productCollection.CountDocuments(ctx, bson.D{primitive.E{Key: "_id", Value: productID}})
+	if err != nil {
+		log.Println(err)
+		return ErrCantUpdateProduct
+	}
+	if count == 0 {
+		return ErrCantFindProduct
+	}
+	return alreadyErr
+}
+
+// ListProducts returns one page of products matching the filter, newest
+// first, along with the number of products that match in total.
+func ListProducts(ctx context.Context, productCollection *mongo.Collection, filter ProductFilter, page int64, perPage int64) ([]models.Product, int64, error) {
+	query := filter.query()
+
+	total, err := productCollection.CountDocuments(ctx, query)
+	if err != nil {
+		log.Println(err)
+		return nil, 0, ErrCantListProducts
+	}
+
+	products := make([]models.Product, 0)
+	if total == 0 {
+		return products, 0, nil
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip((page - 1) * perPage).
+		SetLimit(perPage)
+
+	cursor, err := productCollection.Find(ctx, query, opts)
+	if err != nil {
+		log.Println(err)
+		return nil, 0, ErrCantListProducts
+	}
+
+	if err = cursor.All(ctx, &products); err != nil {
+		log.Println(err)
+		return nil, 0, ErrCantListProducts
+	}
+
+	return products, total, nil
+}
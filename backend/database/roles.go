@@ -0,0 +1,117 @@
+package database
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/GadirB/ecommerce-go/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrUnknownRole = NewError(KindInvalid, "unknown_role", "unknown role")
+	ErrCantUpdateRoles = NewError(KindInternal, "cant_update_roles", "can't update roles")
+)
+
+var knownRoles = map[models.Role]bool{
+	models.RoleCustomer: true,
+	models.RoleAdmin: true,
+	models.RoleSupport: true,
+	models.RoleWarehouse: true,
+}
+
+func IsKnownRole(role models.Role) bool {
+	return knownRoles[role]
+}
+
+// EffectiveRoles returns the roles a user acts with. Users created before
+// roles existed have none stored and are treated as customers.
+func EffectiveRoles(user models.User) []models.Role {
+	if len(user.Roles) == 0 {
+		return []models.Role{models.RoleCustomer}
+	}
+	return user.Roles
+}
+
+// GrantRole adds a role to a user. Roles are embedded in tokens, so the
+// change applies from the user's next login.
+func GrantRole(ctx context.Context, userCollection *mongo.Collection, userID string, role models.Role) (models.User, error) {
+	update := bson.D{{Key: "$addToSet", Value: bson.D{primitive.E{Key: "roles", Value: role}}}}
+	return updateRoles(ctx, userCollection, userID, role, update)
+}
+
+// RevokeRole removes a role from a user. Their tokens still carry it, so
+// the caller has to end the user's sessions.
+func RevokeRole(ctx context.Context, userCollection *mongo.Collection, userID string, role models.Role) (models.User, error) {
+	update := bson.D{{Key: "$pull", Value: bson.D{primitive.E{Key: "roles", Value: role}}}}
+	return updateRoles(ctx, userCollection, userID, role, update)
+}
+
+func updateRoles(ctx context.Context, userCollection *mongo.Collection, userID string, role models.Role, update bson.D) (models.User, error) {
+	var user models.User
+
+	if !IsKnownRole(role) {
+		return user, ErrUnknownRole
+	}
+
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		log.Println(err)
+		return user, ErrUserIdIsNotValid
+	}
+
+	// Materialise the implicit customer role first so that revoking another
+	// role never leaves a legacy user with an empty role list.
+	legacy := bson.D{primitive.E{Key: "_id", Value: id}, {Key: "roles", Value: bson.D{primitive.E{Key: "$in", Value: bson.A{nil, bson.A{}}}}}}
+	seed := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "roles", Value: bson.A{models.RoleCustomer}}}}}
+	if _, err = userCollection.UpdateOne(ctx, legacy, seed); err != nil {
+		log.Println(err)
+		return user, ErrCantUpdateRoles
+	}
+
+	result, err := userCollection.UpdateOne(ctx, bson.D{primitive.E{Key: "_id", Value: id}}, update)
+	if err != nil {
+		log.Println(err)
+		return user, ErrCantUpdateRoles
+	}
+	if result.MatchedCount == 0 {
+		return user, ErrUserIdIsNotValid
+	}
+
+	if err = userCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: id}}).Decode(&user); err != nil {
+		log.Println(err)
+		return user, ErrCantUpdateRoles
+	}
+
+	return user, nil
+}
+
+// BootstrapAdmins grants the admin role to the users with the given
+// comma-separated emails, so a fresh deployment has someone able to use the
+// admin endpoints.
+func BootstrapAdmins(ctx context.Context, userCollection *mongo.Collection, emails string) error {
+	for _, email := range strings.Split(emails, ",") {
+		email = strings.TrimSpace(email)
+		if email == "" {
+			continue
+		}
+
+		var user models.User
+		err := userCollection.FindOne(ctx, bson.D{primitive.E{Key: "email", Value: email}}).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			log.Printf("admin bootstrap: no user with email %s", email)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err = GrantRole(ctx, userCollection, user.User_ID, models.RoleAdmin); err != nil {
+			return err
+		}
+	}
+	return nil
+}
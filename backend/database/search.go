@@ -0,0 +1,365 @@
+package database
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/GadirB/ecommerce-go/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	ErrEmptySearch = NewError(KindInvalid, "empty_search", "search needs at least one letter or digit")
+	ErrSearchTooLong = NewError(KindInvalid, "search_too_long", "search is too long")
+	ErrCantSearchProducts = NewError(KindInternal, "cant_search_products", "can't search products")
+)
+
+const (
+	// MaxSearchLength is the longest search accepted, in bytes.
+	MaxSearchLength = 200
+	// maxSearchTerms is how many words of a search are used.
+	maxSearchTerms = 10
+	// typeaheadCandidates is how many products a prefix search ranks before
+	// cutting to the limit.
+	typeaheadCandidates = 200
+)
+
+// searchTermsField holds the folded words of a product's name, for prefix
+// searches. CreateProduct and UpdateProduct keep it current.
+const searchTermsField = "search_terms"
+
+// foldRune lower-cases r and strips its accents, so that "É" and "e" search
+// alike. The text index folds the same way.
+func foldRune(r rune) string {
+	var folded strings.Builder
+	for _, part := range norm.NFD.String(string(r)) {
+		if !unicode.Is(unicode.Mn, part) {
+			folded.WriteRune(unicode.ToLower(part))
+		}
+	}
+	return folded.String()
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+}
+
+// searchWord is a word of a text: where it is, in bytes, and its folded
+// form. Ends[i] is the length of the folded form of the word's first i+1
+// runes, and Offsets[i] the byte offset in the text just past that rune.
+type searchWord struct {
+	Start int
+	End int
+	Folded string
+	Ends []int
+	Offsets []int
+}
+
+func splitWords(text string) []searchWord {
+	var words []searchWord
+	var current *searchWord
+	for offset, r := range text {
+		if !isWordRune(r) {
+			current = nil
+			continue
+		}
+		if current == nil {
+			words = append(words, searchWord{Start: offset})
+			current = &words[len(words)-1]
+		}
+		current.Folded += foldRune(r)
+		current.End = offset + len(string(r))
+		current.Ends = append(current.Ends, len(current.Folded))
+		current.Offsets = append(current.Offsets, current.End)
+	}
+
+	// A word of lone accents folds to nothing.
+	kept := words[:0]
+	for _, word := range words {
+		if word.Folded != "" {
+			kept = append(kept, word)
+		}
+	}
+	return kept
+}
+
+// SearchTerms returns the folded words of text, each once.
+func SearchTerms(text string) []string {
+	terms := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, word := range splitWords(text) {
+		if !seen[word.Folded] {
+			seen[word.Folded] = true
+			terms = append(terms, word.Folded)
+		}
+	}
+	return terms
+}
+
+// SearchQuery is a product search. Text is what the customer typed. With
+// Prefix set, the last word matches any word it starts, for typeahead;
+// a search ending in a space or punctuation has no partial word.
+type SearchQuery struct {
+	Text string
+	Prefix bool
+	Limit int64
+}
+
+// SearchResult is a product found by a search. Score ranks it, higher
+// first; Matches are the [start, end) byte ranges of the product name
+// that matched the search.
+type SearchResult struct {
+	Product models.Product
+	Score float64
+	Matches [][2]int
+}
+
+// parsedSearch is a search split into the words that must match whole and
+// the partial word being typed, if any.
+type parsedSearch struct {
+	Terms []string
+	Partial string
+}
+
+func parseSearch(query SearchQuery) (parsedSearch, error) {
+	var parsed parsedSearch
+	if len(query.Text) > MaxSearchLength {
+		return parsed, ErrSearchTooLong
+	}
+
+	words := splitWords(query.Text)
+	if len(words) == 0 {
+		return parsed, ErrEmptySearch
+	}
+	if len(words) > maxSearchTerms {
+		words = words[:maxSearchTerms]
+	}
+
+	last := words[len(words)-1]
+	if query.Prefix && last.End == len(query.Text) {
+		parsed.Partial = last.Folded
+		words = words[:len(words)-1]
+	}
+
+	seen := make(map[string]bool)
+	for _, word := range words {
+		if !seen[word.Folded] && word.Folded != parsed.Partial {
+			seen[word.Folded] = true
+			parsed.Terms = append(parsed.Terms, word.Folded)
+		}
+	}
+	return parsed, nil
+}
+
+// match scores a product name against the search and finds the words that
+// matched. Whole words count 1, a word the partial one starts counts 0.5,
+// and the first word matching earns 0.5 more.
+func (s parsedSearch) match(name string) (float64, [][2]int) {
+	var score float64
+	matches := make([][2]int, 0)
+	found := make(map[string]bool)
+
+	for i, word := range splitWords(name) {
+		weight := 0.0
+		end := 0
+		for _, term := range s.Terms {
+			if word.Folded == term {
+				if !found[term] {
+					weight = 1
+				}
+				found[term] = true
+				end = word.End
+			}
+		}
+		if end == 0 && s.Partial != "" && strings.HasPrefix(word.Folded, s.Partial) {
+			if !found[s.Partial] {
+				weight = 0.5
+			}
+			found[s.Partial] = true
+			for r, foldedEnd := range word.Ends {
+				if foldedEnd >= len(s.Partial) {
+					end = word.Offsets[r]
+					break
+				}
+			}
+		}
+		if end == 0 {
+			continue
+		}
+		if i == 0 {
+			weight += 0.5
+		}
+		score += weight
+		matches = append(matches, [2]int{word.Start, end})
+	}
+	return score, matches
+}
+
+// EnsureSearchIndexes creates the text index full-word searches use and the
+// index prefix searches use.
+func EnsureSearchIndexes(ctx context.Context, productCollection *mongo.Collection) error {
+	_, err := productCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "product_name", Value: "text"}},
+			// No stemming or stop words, so the index matches the words
+			// highlighted in results.
+			Options: options.Index().SetName("product_search").SetDefaultLanguage("none"),
+		},
+		{Keys: bson.D{{Key: searchTermsField, Value: 1}}},
+	})
+	return err
+}
+
+// MigrateProductSearchTerms fills in the search terms of products created
+// before prefix search.
+func MigrateProductSearchTerms(ctx context.Context, productCollection *mongo.Collection) error {
+	filter := bson.D{primitive.E{Key: searchTermsField, Value: bson.D{primitive.E{Key: "$exists", Value: false}}}}
+	cursor, err := productCollection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	updated := 0
+	for cursor.Next(ctx) {
+		var product models.Product
+		if err := cursor.Decode(&product); err != nil {
+			return err
+		}
+		var name string
+		if product.Product_Name != nil {
+			name = *product.Product_Name
+		}
+		update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: searchTermsField, Value: SearchTerms(name)}}}}
+		if _, err := productCollection.UpdateOne(ctx, bson.D{primitive.E{Key: "_id", Value: product.Product_ID}}, update); err != nil {
+			return err
+		}
+		updated++
+	}
+	if updated > 0 {
+		log.Printf("set search terms on %d products", updated)
+	}
+	return cursor.Err()
+}
+
+// SearchProducts finds the products customers can buy whose names match the
+// search, best match first. Whole words are found through the text index and
+// ranked by its score; a search with a partial word goes through the search
+// terms instead and requires every whole word.
+func SearchProducts(ctx context.Context, productCollection *mongo.Collection, query SearchQuery) ([]SearchResult, error) {
+	results := make([]SearchResult, 0)
+
+	parsed, err := parseSearch(query)
+	if err != nil {
+		return results, err
+	}
+
+	if parsed.Partial == "" {
+		return searchText(ctx, productCollection, parsed, query.Limit)
+	}
+	return searchPrefix(ctx, productCollection, parsed, query.Limit)
+}
+
+func searchText(ctx context.Context, productCollection *mongo.Collection, parsed parsedSearch, limit int64) ([]SearchResult, error) {
+	results := make([]SearchResult, 0)
+
+	// The terms hold only letters and digits, so none of them can be read
+	// as a phrase or a negation by $search.
+	filter := bson.D{
+		primitive.E{Key: "$text", Value: bson.D{primitive.E{Key: "$search", Value: strings.Join(parsed.Terms, " ")}}},
+		NotDeleted,
+	}
+	score := bson.D{primitive.E{Key: "$meta", Value: "textScore"}}
+	opts := options.Find().
+		SetProjection(bson.D{{Key: "score", Value: score}}).
+		SetSort(bson.D{{Key: "score", Value: score}, {Key: "_id", Value: 1}}).
+		SetLimit(limit)
+
+	cursor, err := productCollection.Find(ctx, filter, opts)
+	if err != nil {
+		log.Println(err)
+		return results, ErrCantSearchProducts
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var found struct {
+			Product models.Product `bson:",inline"`
+			Score float64 `bson:"score"`
+		}
+		if err := cursor.Decode(&found); err != nil {
+			log.Println(err)
+			return results, ErrCantSearchProducts
+		}
+		var name string
+		if found.Product.Product_Name != nil {
+			name = *found.Product.Product_Name
+		}
+		_, matches := parsed.match(name)
+		results = append(results, SearchResult{Product: found.Product, Score: found.Score, Matches: matches})
+	}
+	if err := cursor.Err(); err != nil {
+		log.Println(err)
+		return results, ErrCantSearchProducts
+	}
+	return results, nil
+}
+
+func searchPrefix(ctx context.Context, productCollection *mongo.Collection, parsed parsedSearch, limit int64) ([]SearchResult, error) {
+	results := make([]SearchResult, 0)
+
+	// An anchored prefix without options is answered from the index; the
+	// partial word is quoted so it can only match literally.
+	partial := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(parsed.Partial)}
+	conditions := bson.A{bson.D{primitive.E{Key: searchTermsField, Value: partial}}}
+	if len(parsed.Terms) > 0 {
+		conditions = append(conditions, bson.D{primitive.E{Key: searchTermsField, Value: bson.D{primitive.E{Key: "$all", Value: parsed.Terms}}}})
+	}
+	filter := bson.D{primitive.E{Key: "$and", Value: conditions}, NotDeleted}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "rating", Value: -1}, {Key: "_id", Value: 1}}).
+		SetLimit(typeaheadCandidates)
+
+	cursor, err := productCollection.Find(ctx, filter, opts)
+	if err != nil {
+		log.Println(err)
+		return results, ErrCantSearchProducts
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var product models.Product
+		if err := cursor.Decode(&product); err != nil {
+			log.Println(err)
+			return results, ErrCantSearchProducts
+		}
+		var name string
+		if product.Product_Name != nil {
+			name = *product.Product_Name
+		}
+		score, matches := parsed.match(name)
+		results = append(results, SearchResult{Product: product, Score: score, Matches: matches})
+	}
+	if err := cursor.Err(); err != nil {
+		log.Println(err)
+		return results, ErrCantSearchProducts
+	}
+
+	// Candidates come best rated first, so among equal scores the stable
+	// sort keeps better rated products ahead.
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	if int64(len(results)) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
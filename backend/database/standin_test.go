@@ -0,0 +1,304 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/address"
+	"go.mongodb.org/mongo-driver/mongo/description"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/wiremessage"
+)
+
+// standIn is an in-memory MongoDB stand-in the driver talks to over the wire
+// protocol, so tests run the same queries as production without a server.
+// It understands find with equality and $in filters, which is what the
+// code under test sends; any other command fails the operation.
+type standIn struct {
+	mu sync.Mutex
+	collections map[string][]bson.Raw
+	finds []bson.Raw
+}
+
+const standInAddress = address.Address("standin:27017")
+
+var standInSessionTimeout int64 = 30
+
+// newStandIn returns a stand-in and a client connected to it.
+func newStandIn(t *testing.T) (*standIn, *mongo.Client) {
+	t.Helper()
+	server := &standIn{collections: make(map[string][]bson.Raw)}
+
+	opts := options.Client()
+	opts.Deployment = server
+	client, err := mongo.Connect(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	return server, client
+}
+
+// insert stores documents in the named collection of the Ecommerce database.
+func (s *standIn) insert(t *testing.T, collection string, documents ...interface{}) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, document := range documents {
+		data, err := bson.Marshal(document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.collections["Ecommerce."+collection] = append(s.collections["Ecommerce."+collection], data)
+	}
+}
+
+// findFilters returns the filters of the finds run on a collection.
+func (s *standIn) findFilters(collection string) []bson.Raw {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var filters []bson.Raw
+	for _, command := range s.finds {
+		if command.Lookup("find").StringValue() == collection {
+			filter, _ := command.Lookup("filter").DocumentOK()
+			filters = append(filters, filter)
+		}
+	}
+	return filters
+}
+
+func (s *standIn) run(command bson.Raw) bson.D {
+	elements, err := command.Elements()
+	if err != nil || len(elements) == 0 {
+		return commandError("empty command")
+	}
+
+	switch name := elements[0].Key(); name {
+	case "find":
+		return s.find(command)
+	case "endSessions", "ping":
+		return bson.D{{Key: "ok", Value: 1}}
+	default:
+		return commandError("unsupported command " + name)
+	}
+}
+
+func (s *standIn) find(command bson.Raw) bson.D {
+	namespace := command.Lookup("$db").StringValue() + "." + command.Lookup("find").StringValue()
+	filter, _ := command.Lookup("filter").DocumentOK()
+	limit, _ := command.Lookup("limit").AsInt64OK()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finds = append(s.finds, command)
+
+	batch := bson.A{}
+	for _, document := range s.collections[namespace] {
+		matched, err := matches(filter, document)
+		if err != nil {
+			return commandError(err.Error())
+		}
+		if matched {
+			batch = append(batch, document)
+		}
+		if limit > 0 && int64(len(batch)) == limit {
+			break
+		}
+	}
+
+	return bson.D{
+		{Key: "cursor", Value: bson.D{
+			{Key: "firstBatch", Value: batch},
+			{Key: "id", Value: int64(0)},
+			{Key: "ns", Value: namespace},
+		}},
+		{Key: "ok", Value: 1},
+	}
+}
+
+func commandError(message string) bson.D {
+	return bson.D{{Key: "ok", Value: 0}, {Key: "errmsg", Value: "stand-in: " + message}, {Key: "code", Value: 115}}
+}
+
+func sameValue(a, b bson.RawValue) bool {
+	return a.Type == b.Type && bytes.Equal(a.Value, b.Value)
+}
+
+// matches reports whether document matches filter, which may only test
+// top-level fields for equality or with $in.
+func matches(filter bson.Raw, document bson.Raw) (bool, error) {
+	elements, err := filter.Elements()
+	if err != nil {
+		return false, err
+	}
+	for _, element := range elements {
+		if strings.HasPrefix(element.Key(), "$") {
+			return false, fmt.Errorf("unsupported operator %s", element.Key())
+		}
+		actual, _ := document.LookupErr(element.Key())
+
+		condition, isDocument := element.Value().DocumentOK()
+		operators, _ := condition.Elements()
+		if !isDocument || len(operators) == 0 || !strings.HasPrefix(operators[0].Key(), "$") {
+			if !sameValue(actual, element.Value()) {
+				return false, nil
+			}
+			continue
+		}
+
+		for _, operator := range operators {
+			if operator.Key() != "$in" {
+				return false, fmt.Errorf("unsupported operator %s", operator.Key())
+			}
+			candidates, _ := operator.Value().Array().Values()
+			found := false
+			for _, candidate := range candidates {
+				found = found || sameValue(actual, candidate)
+			}
+			if !found {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// The driver side: the stand-in is its own deployment and server, and hands
+// out one connection per operation so concurrent operations don't share
+// replies.
+
+var (
+	_ driver.Deployment = &standIn{}
+	_ driver.Server = &standIn{}
+	_ driver.Connector = &standIn{}
+	_ driver.Disconnector = &standIn{}
+	_ driver.Subscriber = &standIn{}
+)
+
+func (s *standIn) SelectServer(context.Context, description.ServerSelector) (driver.Server, error) {
+	return s, nil
+}
+
+func (s *standIn) Kind() description.TopologyKind {
+	return description.Single
+}
+
+func (s *standIn) Connection(context.Context) (driver.Connection, error) {
+	return &standInConnection{server: s}, nil
+}
+
+func (s *standIn) RTTMonitor() driver.RTTMonitor {
+	return zeroRTT{}
+}
+
+func (s *standIn) Connect() error {
+	return nil
+}
+
+func (s *standIn) Disconnect(context.Context) error {
+	return nil
+}
+
+func (s *standIn) Subscribe() (*driver.Subscription, error) {
+	updates := make(chan description.Topology, 1)
+	updates <- description.Topology{SessionTimeoutMinutesPtr: &standInSessionTimeout}
+	return &driver.Subscription{Updates: updates}, nil
+}
+
+func (s *standIn) Unsubscribe(*driver.Subscription) error {
+	return nil
+}
+
+type zeroRTT struct{}
+
+func (zeroRTT) EWMA() time.Duration { return 0 }
+func (zeroRTT) Min() time.Duration { return 0 }
+func (zeroRTT) P90() time.Duration { return 0 }
+func (zeroRTT) Stats() string { return "" }
+
+type standInConnection struct {
+	server *standIn
+	reply []byte
+}
+
+var _ driver.Connection = &standInConnection{}
+
+// WriteWireMessage runs the OP_MSG command in message and keeps the reply
+// for ReadWireMessage.
+func (c *standInConnection) WriteWireMessage(_ context.Context, message []byte) error {
+	_, requestID, _, opcode, rest, ok := wiremessage.ReadHeader(message)
+	if !ok || opcode != wiremessage.OpMsg {
+		return errors.New("stand-in: only OP_MSG is supported")
+	}
+	if _, rest, ok = wiremessage.ReadMsgFlags(rest); !ok {
+		return errors.New("stand-in: malformed message")
+	}
+
+	var command bsoncore.Document
+	for len(rest) > 0 {
+		var sectionType wiremessage.SectionType
+		if sectionType, rest, ok = wiremessage.ReadMsgSectionType(rest); !ok {
+			return errors.New("stand-in: malformed section")
+		}
+		if sectionType != wiremessage.SingleDocument {
+			return errors.New("stand-in: document sequences are not supported")
+		}
+		if command, rest, ok = wiremessage.ReadMsgSectionSingleDocument(rest); !ok {
+			return errors.New("stand-in: malformed document")
+		}
+	}
+
+	reply, err := bson.Marshal(c.server.run(bson.Raw(command)))
+	if err != nil {
+		return err
+	}
+
+	index, wire := wiremessage.AppendHeaderStart(nil, wiremessage.NextRequestID(), requestID, wiremessage.OpMsg)
+	wire = wiremessage.AppendMsgFlags(wire, 0)
+	wire = wiremessage.AppendMsgSectionType(wire, wiremessage.SingleDocument)
+	wire = append(wire, reply...)
+	c.reply = bsoncore.UpdateLength(wire, index, int32(len(wire[index:])))
+	return nil
+}
+
+func (c *standInConnection) ReadWireMessage(context.Context) ([]byte, error) {
+	if c.reply == nil {
+		return nil, errors.New("stand-in: no reply pending")
+	}
+	reply := c.reply
+	c.reply = nil
+	return reply, nil
+}
+
+func (c *standInConnection) Description() description.Server {
+	return description.Server{
+		Addr: standInAddress,
+		CanonicalAddr: standInAddress,
+		Kind: description.Standalone,
+		MaxDocumentSize: 16 * 1024 * 1024,
+		MaxMessageSize: 48 * 1000 * 1000,
+		MaxBatchCount: 100000,
+		SessionTimeoutMinutesPtr: &standInSessionTimeout,
+		WireVersion: &description.VersionRange{Max: topology.SupportedWireVersions.Max},
+	}
+}
+
+func (*standInConnection) Close() error { return nil }
+func (*standInConnection) ID() string { return "standin" }
+func (*standInConnection) ServerConnectionID() *int64 { return nil }
+func (*standInConnection) DriverConnectionID() uint64 { return 0 }
+func (*standInConnection) Address() address.Address { return standInAddress }
+func (*standInConnection) Stale() bool { return false }
+func (*standInConnection) OIDCTokenGenID() uint64 { return 0 }
+func (*standInConnection) SetOIDCTokenGenID(uint64) {}
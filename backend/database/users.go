@@ -0,0 +1,156 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/GadirB/ecommerce-go/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrEmailInUse = NewError(KindConflict, "email_in_use", "this email is already in use")
+	ErrPhoneInUse = NewError(KindConflict, "phone_in_use", "this phone is already in use")
+	ErrCantDeleteUser = NewError(KindInternal, "cant_delete_user", "can't delete user")
+)
+
+func GetUser(ctx context.Context, userCollection *mongo.Collection, userID string) (models.User, error) {
+	var user models.User
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return user, ErrUserIdIsNotValid
+	}
+	if err = userCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: id}}).Decode(&user); err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Println(err)
+		}
+		return user, ErrUserIdIsNotValid
+	}
+	return user, nil
+}
+
+// inUseByOther reports whether another user already has value in field.
+func inUseByOther(ctx context.Context, userCollection *mongo.Collection, id primitive.ObjectID, field string, value string) (bool, error) {
+	filter := bson.D{primitive.E{Key: field, Value: value}, {Key: "_id", Value: bson.D{primitive.E{Key: "$ne", Value: id}}}}
+	count, err := userCollection.CountDocuments(ctx, filter)
+	if err != nil {
+		log.Println(err)
+		return false, ErrCantUpdateUser
+	}
+	return count > 0, nil
+}
+
+// UpdateProfile sets the given profile fields (first_name, last_name and
+// phone) and returns the updated user.
+func UpdateProfile(ctx context.Context, userCollection *mongo.Collection, userID string, fields bson.D) (models.User, error) {
+	var user models.User
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return user, ErrUserIdIsNotValid
+	}
+
+	for _, field := range fields {
+		if phone, ok := field.Value.(string); ok && field.Key == "phone" {
+			inUse, err := inUseByOther(ctx, userCollection, id, "phone", phone)
+			if err != nil {
+				return user, err
+			}
+			if inUse {
+				return user, ErrPhoneInUse
+			}
+		}
+	}
+
+	fields = append(fields, bson.E{Key: "updated_at", Value: time.Now()})
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = userCollection.FindOneAndUpdate(ctx, bson.D{primitive.E{Key: "_id", Value: id}}, bson.D{{Key: "$set", Value: fields}}, opts).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return user, ErrUserIdIsNotValid
+	}
+	if err != nil {
+		log.Println(err)
+		return user, ErrCantUpdateUser
+	}
+	return user, nil
+}
+
+// RequestEmailChange records email as the address the user wants to move
+// to. The account keeps its current address until VerifyEmail is given a
+// token sent to the new one.
+func RequestEmailChange(ctx context.Context, userCollection *mongo.Collection, userID string, email string) error {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return ErrUserIdIsNotValid
+	}
+
+	inUse, err := inUseByOther(ctx, userCollection, id, "email", email)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return ErrEmailInUse
+	}
+
+	update := bson.D{{Key: "$set", Value: bson.D{
+		primitive.E{Key: "pending_email", Value: email},
+		{Key: "updated_at", Value: time.Now()},
+	}}}
+	result, err := userCollection.UpdateOne(ctx, bson.D{primitive.E{Key: "_id", Value: id}}, update)
+	if err != nil {
+		log.Println(err)
+		return ErrCantUpdateUser
+	}
+	if result.MatchedCount == 0 {
+		return ErrUserIdIsNotValid
+	}
+	return nil
+}
+
+// DeleteUser deletes the user's account and gives back the stock held by
+// their cart. Their orders are kept.
+func DeleteUser(ctx context.Context, userCollection *mongo.Collection, productCollection *mongo.Collection, reservationCollection *mongo.Collection, userID string) error {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return ErrUserIdIsNotValid
+	}
+
+	_, err = runInTransaction(ctx, userCollection, func(sc mongo.SessionContext) (interface{}, error) {
+		cursor, err := reservationCollection.Find(sc, bson.D{primitive.E{Key: "user_id", Value: userID}})
+		if err != nil {
+			return nil, err
+		}
+
+		var reservations []models.Reservation
+		if err = cursor.All(sc, &reservations); err != nil {
+			return nil, err
+		}
+
+		for _, reservation := range reservations {
+			if err = ReleaseStock(sc, productCollection, reservationCollection, userID, reservation.Product_ID, 0); err != nil {
+				return nil, err
+			}
+		}
+
+		result, err := userCollection.DeleteOne(sc, bson.D{primitive.E{Key: "_id", Value: id}})
+		if err != nil {
+			return nil, err
+		}
+		if result.DeletedCount == 0 {
+			return nil, ErrUserIdIsNotValid
+		}
+		return nil, nil
+	})
+	if errors.Is(err, ErrUserIdIsNotValid) {
+		return err
+	}
+	if err != nil {
+		log.Println(err)
+		return ErrCantDeleteUser
+	}
+	return nil
+}
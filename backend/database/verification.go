@@ -0,0 +1,231 @@
+package database
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/GadirB/ecommerce-go/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrCantCreateVerification = NewError(KindInternal, "cant_create_verification", "can't create email verification")
+	ErrVerificationTokenInvalid = NewError(KindInvalid, "verification_token_invalid", "verification token is invalid or has expired")
+	ErrCantVerifyEmail = NewError(KindInternal, "cant_verify_email", "can't verify email")
+	ErrEmailAlreadyVerified = NewError(KindConflict, "email_already_verified", "email is already verified")
+	ErrTooManyVerificationEmails = NewError(KindTooManyRequests, "too_many_verification_emails", "too many verification emails requested, try again later")
+)
+
+var (
+	// EmailVerificationTTL is how long a verification link stays usable.
+	EmailVerificationTTL = 48 * time.Hour
+	// VerificationResendInterval is the least time between two verification
+	// emails to the same user, and VerificationResendLimit how many of them
+	// may be sent per day.
+	VerificationResendInterval = time.Minute
+	VerificationResendLimit = 5
+)
+
+func VerificationData(client *mongo.Client, collectionName string) *mongo.Collection{
+	var verificationCollection *mongo.Collection = client.Database("Ecommerce").Collection(collectionName)
+	return verificationCollection
+}
+
+// EnsureVerificationIndexes creates the token lookup index, the per-user
+// index used for rate limiting and a TTL index that drops verifications a
+// day after they expire, so they still count towards the daily limit.
+func EnsureVerificationIndexes(ctx context.Context, verificationCollection *mongo.Collection) error {
+	_, err := verificationCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{
+			Keys: bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32((24 * time.Hour).Seconds())),
+		},
+	})
+	return err
+}
+
+// MigrateEmailVerification marks users created before email verification
+// existed as verified, so the verified email policy doesn't lock them out.
+func MigrateEmailVerification(ctx context.Context, userCollection *mongo.Collection) error {
+	filter := bson.D{primitive.E{Key: "email_verified", Value: bson.D{primitive.E{Key: "$exists", Value: false}}}}
+	update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "email_verified", Value: true}}}}
+
+	result, err := userCollection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount > 0 {
+		log.Printf("marked %d existing users as email verified", result.ModifiedCount)
+	}
+	return nil
+}
+
+// CreateEmailVerification returns a token proving the user owns email, to
+// be mailed to that address. Requests are rate limited per user by
+// VerificationResendInterval and VerificationResendLimit.
+func CreateEmailVerification(ctx context.Context, verificationCollection *mongo.Collection, userID string, email string) (string, error) {
+	now := time.Now()
+	filter := bson.D{
+		primitive.E{Key: "user_id", Value: userID},
+		{Key: "created_at", Value: bson.D{primitive.E{Key: "$gt", Value: now.Add(-24 * time.Hour)}}},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(int64(VerificationResendLimit))
+
+	cursor, err := verificationCollection.Find(ctx, filter, opts)
+	if err != nil {
+		log.Println(err)
+		return "", ErrCantCreateVerification
+	}
+
+	var recent []models.EmailVerification
+	if err = cursor.All(ctx, &recent); err != nil {
+		log.Println(err)
+		return "", ErrCantCreateVerification
+	}
+	if len(recent) >= VerificationResendLimit || (len(recent) > 0 && now.Sub(recent[0].Created_At) < VerificationResendInterval) {
+		return "", ErrTooManyVerificationEmails
+	}
+
+	token, tokenHash, err := newOpaqueToken()
+	if err != nil {
+		log.Println(err)
+		return "", ErrCantCreateVerification
+	}
+
+	_, err = verificationCollection.InsertOne(ctx, models.EmailVerification{
+		Verification_ID: primitive.NewObjectID(),
+		User_ID: userID,
+		Email: email,
+		Token_Hash: tokenHash,
+		Created_At: now,
+		Expires_At: now.Add(EmailVerificationTTL),
+	})
+	if err != nil {
+		log.Println(err)
+		return "", ErrCantCreateVerification
+	}
+
+	return token, nil
+}
+
+// VerifyEmail marks the user's email verified with a token from
+// CreateEmailVerification. The token is only honoured if the user still has
+// the address it was sent to, either as their email or as the pending email
+// of a change, which it then completes.
+func VerifyEmail(ctx context.Context, verificationCollection *mongo.Collection, userCollection *mongo.Collection, token string) error {
+	filter := bson.D{
+		primitive.E{Key: "token_hash", Value: hashToken(token)},
+		{Key: "expires_at", Value: bson.D{primitive.E{Key: "$gt", Value: time.Now()}}},
+	}
+
+	var verification models.EmailVerification
+	err := verificationCollection.FindOne(ctx, filter).Decode(&verification)
+	if err == mongo.ErrNoDocuments {
+		return ErrVerificationTokenInvalid
+	}
+	if err != nil {
+		log.Println(err)
+		return ErrCantVerifyEmail
+	}
+
+	id, err := primitive.ObjectIDFromHex(verification.User_ID)
+	if err != nil {
+		return ErrVerificationTokenInvalid
+	}
+
+	now := time.Now()
+	verified := bson.D{
+		primitive.E{Key: "email_verified", Value: true},
+		{Key: "email_verified_at", Value: now},
+		{Key: "updated_at", Value: now},
+	}
+
+	matched, err := completeEmailChange(ctx, userCollection, id, verification.Email, verified)
+	if err != nil {
+		return err
+	}
+	if !matched {
+		userFilter := bson.D{primitive.E{Key: "_id", Value: id}, {Key: "email", Value: verification.Email}}
+		result, err := userCollection.UpdateOne(ctx, userFilter, bson.D{{Key: "$set", Value: verified}})
+		if err != nil {
+			log.Println(err)
+			return ErrCantVerifyEmail
+		}
+		if result.MatchedCount == 0 {
+			return ErrVerificationTokenInvalid
+		}
+	}
+
+	// Spent tokens are kept until the TTL index drops them so they keep
+	// counting towards the resend limit; only their expiry is moved up.
+	_, err = verificationCollection.UpdateMany(ctx,
+		bson.D{primitive.E{Key: "user_id", Value: verification.User_ID}},
+		bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "expires_at", Value: now}}}},
+	)
+	if err != nil {
+		log.Println(err)
+	}
+
+	return nil
+}
+
+// completeEmailChange moves the user to email if it is their pending email,
+// reporting whether it was. The address is checked again because someone
+// else may have signed up with it while the change was pending.
+func completeEmailChange(ctx context.Context, userCollection *mongo.Collection, id primitive.ObjectID, email string, verified bson.D) (bool, error) {
+	count, err := userCollection.CountDocuments(ctx, bson.D{primitive.E{Key: "_id", Value: id}, {Key: "pending_email", Value: email}})
+	if err != nil {
+		log.Println(err)
+		return false, ErrCantVerifyEmail
+	}
+	if count == 0 {
+		return false, nil
+	}
+
+	inUse, err := inUseByOther(ctx, userCollection, id, "email", email)
+	if err != nil {
+		return false, err
+	}
+	if inUse {
+		return false, ErrEmailInUse
+	}
+
+	update := bson.D{
+		{Key: "$set", Value: append(bson.D{primitive.E{Key: "email", Value: email}}, verified...)},
+		{Key: "$unset", Value: bson.D{primitive.E{Key: "pending_email", Value: ""}}},
+	}
+	result, err := userCollection.UpdateOne(ctx, bson.D{primitive.E{Key: "_id", Value: id}, {Key: "pending_email", Value: email}}, update)
+	if err != nil {
+		log.Println(err)
+		return false, ErrCantVerifyEmail
+	}
+	return result.MatchedCount > 0, nil
+}
+
+// IsEmailVerified reports whether the user has verified their email.
+func IsEmailVerified(ctx context.Context, userCollection *mongo.Collection, userID string) (bool, error) {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return false, ErrUserIdIsNotValid
+	}
+
+	var user models.User
+	opts := options.FindOne().SetProjection(bson.D{{Key: "email_verified", Value: 1}})
+	err = userCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: id}}, opts).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return false, ErrUserIdIsNotValid
+	}
+	if err != nil {
+		return false, err
+	}
+	return user.Email_Verified, nil
+}
@@ -0,0 +1,41 @@
+package dto
+
+import "github.com/GadirB/ecommerce-go/models"
+
+type Address struct {
+	ID string `json:"_id"`
+	Label string `json:"label"`
+	Recipient_Name string `json:"recipient_name"`
+	Phone string `json:"phone"`
+	House_Name string `json:"house_name"`
+	Street_Name string `json:"street_name"`
+	Line_2 string `json:"line_2"`
+	City_Name string `json:"city_name"`
+	Region string `json:"region"`
+	Postal_Code string `json:"postal_code"`
+	Country string `json:"country"`
+	Default_Shipping bool `json:"default_shipping"`
+	Default_Billing bool `json:"default_billing"`
+}
+
+func NewAddress(address models.Address) Address {
+	return Address{
+		ID: address.Address_ID.Hex(),
+		Label: Deref(address.Label),
+		Recipient_Name: Deref(address.Recipient_Name),
+		Phone: Deref(address.Phone),
+		House_Name: Deref(address.House),
+		Street_Name: Deref(address.Street),
+		Line_2: Deref(address.Line_2),
+		City_Name: Deref(address.City),
+		Region: Deref(address.Region),
+		Postal_Code: Deref(address.Postal_Code),
+		Country: Deref(address.Country),
+		Default_Shipping: address.Default_Shipping,
+		Default_Billing: address.Default_Billing,
+	}
+}
+
+func NewAddresses(addresses []models.Address) []Address {
+	return mapAll(addresses, NewAddress)
+}
@@ -0,0 +1,74 @@
+package dto
+
+import (
+	"github.com/GadirB/ecommerce-go/database"
+	"github.com/GadirB/ecommerce-go/models"
+)
+
+// CartItem is a product in a cart or an order, as it was when added.
+type CartItem struct {
+	ID string `json:"_id"`
+	Product_Name string `json:"product_name"`
+	Price int `json:"price"`
+	Rating uint `json:"rating"`
+	Image string `json:"image"`
+	Quantity int `json:"quantity"`
+}
+
+func NewCartItem(item models.ProductUser) CartItem {
+	quantity := item.Quantity
+	if quantity < 1 {
+		quantity = 1
+	}
+	return CartItem{
+		ID: item.Product_ID.Hex(),
+		Product_Name: Deref(item.Product_Name),
+		Price: item.Price,
+		Rating: Deref(item.Rating),
+		Image: Deref(item.Image),
+		Quantity: quantity,
+	}
+}
+
+func NewCartItems(items []models.ProductUser) []CartItem {
+	return mapAll(items, NewCartItem)
+}
+
+type CartLine struct {
+	Product_ID string `json:"product_id"`
+	Product_Name string `json:"product_name"`
+	Unit_Price int `json:"unit_price"`
+	Quantity int `json:"quantity"`
+	Line_Total int `json:"line_total"`
+}
+
+func NewCartLine(line database.PricedLine) CartLine {
+	return CartLine{
+		Product_ID: line.Product_ID.Hex(),
+		Product_Name: Deref(line.Product_Name),
+		Unit_Price: line.Unit_Price,
+		Quantity: line.Quantity,
+		Line_Total: line.Line_Total,
+	}
+}
+
+// Cart is a user's cart with its price breakdown.
+type Cart struct {
+	Cart_Items []CartItem `json:"cart_items"`
+	Lines []CartLine `json:"lines"`
+	Subtotal int `json:"subtotal"`
+	Discount int `json:"discount"`
+	Total_Price int `json:"total_price"`
+	Total_Items int `json:"total_items"`
+}
+
+func NewCart(items []models.ProductUser, pricing database.CartPricing) Cart {
+	return Cart{
+		Cart_Items: NewCartItems(items),
+		Lines: mapAll(pricing.Lines, NewCartLine),
+		Subtotal: pricing.Subtotal,
+		Discount: pricing.Discount,
+		Total_Price: pricing.Total,
+		Total_Items: pricing.Item_Count,
+	}
+}
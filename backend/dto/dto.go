@@ -0,0 +1,23 @@
+// Package dto holds the shapes the API answers with. Handlers map models to
+// these types instead of serializing persistence models, so storage details
+// and secrets can't leak into responses and field names stay stable. IDs
+// are sent as "_id", everything else in snake_case.
+package dto
+
+// Deref returns what value points to, or the zero value when it is nil.
+func Deref[T any](value *T) T {
+	var zero T
+	if value == nil {
+		return zero
+	}
+	return *value
+}
+
+// mapAll maps a slice, never returning nil so empty lists encode as [].
+func mapAll[M any, D any](items []M, mapper func(M) D) []D {
+	mapped := make([]D, 0, len(items))
+	for _, item := range items {
+		mapped = append(mapped, mapper(item))
+	}
+	return mapped
+}
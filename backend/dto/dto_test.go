@@ -0,0 +1,203 @@
+package dto
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GadirB/ecommerce-go/database"
+	"github.com/GadirB/ecommerce-go/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The JSON in testdata is the contract clients rely on. A change that
+// breaks a golden file breaks clients; rerun with -update only when the
+// change is intended.
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func assertGolden(t *testing.T, name string, value interface{}) {
+	t.Helper()
+	got, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	path := filepath.Join("testdata", name+".golden.json")
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test ./dto -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s changed:\n--- got\n%s--- want\n%s", path, got, want)
+	}
+}
+
+func ptr[T any](value T) *T {
+	return &value
+}
+
+var (
+	fixedTime = time.Date(2024, 5, 17, 9, 30, 0, 0, time.UTC)
+	userID = primitive.ObjectID{0x66, 0x47, 0x2a, 0x10, 0, 0, 0, 0, 0, 0, 0, 0x01}
+	addressID = primitive.ObjectID{0x66, 0x47, 0x2a, 0x10, 0, 0, 0, 0, 0, 0, 0, 0x02}
+	productID = primitive.ObjectID{0x66, 0x47, 0x2a, 0x10, 0, 0, 0, 0, 0, 0, 0, 0x03}
+	orderID = primitive.ObjectID{0x66, 0x47, 0x2a, 0x10, 0, 0, 0, 0, 0, 0, 0, 0x04}
+)
+
+func fixtureAddress() models.Address {
+	return models.Address{
+		Address_ID: addressID,
+		Label: ptr("Home"),
+		Recipient_Name: ptr("Ada Lovelace"),
+		Phone: ptr("+442079460000"),
+		House: ptr("12"),
+		Street: ptr("St James's Square"),
+		City: ptr("London"),
+		Postal_Code: ptr("SW1Y 4JH"),
+		Country: ptr("GB"),
+		Default_Shipping: true,
+		Default_Billing: true,
+	}
+}
+
+func fixtureProduct() models.Product {
+	return models.Product{
+		Product_ID: productID,
+		Product_Name: ptr("Brass Desk Lamp"),
+		Price: ptr(uint64(4500)),
+		Rating: ptr(uint8(4)),
+		Image: ptr("https://example.com/lamp.jpg"),
+		Stock: 7,
+		Reserved: 2,
+		Created_At: fixedTime,
+		Updated_At: fixedTime.Add(time.Hour),
+		Search_Terms: []string{"brass", "desk", "lamp"},
+	}
+}
+
+func fixtureCartItem() models.ProductUser {
+	return models.ProductUser{
+		Product_ID: productID,
+		Product_Name: ptr("Brass Desk Lamp"),
+		Price: 4500,
+		Rating: ptr(uint(4)),
+		Image: ptr("https://example.com/lamp.jpg"),
+		Quantity: 2,
+	}
+}
+
+func TestUserGolden(t *testing.T) {
+	user := models.User{
+		ID: userID,
+		User_ID: userID.Hex(),
+		First_Name: ptr("Ada"),
+		Last_Name: ptr("Lovelace"),
+		Password: ptr("$2a$14$hash"),
+		Email: ptr("ada@example.com"),
+		Email_Verified: true,
+		Phone: ptr("+442079460000"),
+		Token: ptr("access-token"),
+		Refresh_Token: ptr("refresh-token"),
+		Created_At: fixedTime,
+		Updated_At: fixedTime,
+		UserCart: []models.ProductUser{fixtureCartItem()},
+		Address_Details: []models.Address{fixtureAddress()},
+		Roles: []models.Role{models.RoleCustomer},
+		MFA_Enabled: true,
+		MFA_Secret: "JBSWY3DPEHPK3PXP",
+		MFA_Recovery_Codes: []string{"recovery-hash"},
+	}
+
+	mapped := NewUser(user, []models.Role{models.RoleCustomer})
+	assertGolden(t, "user", mapped)
+
+	encoded, _ := json.Marshal(mapped)
+	for _, secret := range []string{"$2a$14$hash", "access-token", "refresh-token", "JBSWY3DPEHPK3PXP", "recovery-hash"} {
+		if strings.Contains(string(encoded), secret) {
+			t.Errorf("user response leaks %q", secret)
+		}
+	}
+}
+
+func TestProductGolden(t *testing.T) {
+	assertGolden(t, "product", NewProduct(fixtureProduct()))
+	assertGolden(t, "admin_product", NewAdminProduct(fixtureProduct()))
+	assertGolden(t, "partial_product", NewPartialProduct(fixtureProduct(), []string{"price", "in_stock"}))
+	assertGolden(t, "search_result", NewSearchResult(database.SearchResult{
+		Product: fixtureProduct(),
+		Score: 1.5,
+		Matches: [][2]int{{6, 10}},
+	}))
+}
+
+func TestCartGolden(t *testing.T) {
+	pricing := database.CartPricing{
+		Lines: []database.PricedLine{{
+			Product_ID: productID,
+			Product_Name: ptr("Brass Desk Lamp"),
+			Unit_Price: 4500,
+			Quantity: 2,
+			Line_Total: 9000,
+		}},
+		Item_Count: 2,
+		Subtotal: 9000,
+		Discount: 900,
+		Total: 8100,
+	}
+	assertGolden(t, "cart", NewCart([]models.ProductUser{fixtureCartItem()}, pricing))
+	assertGolden(t, "empty_cart", NewCart(nil, database.CartPricing{}))
+}
+
+func TestOrderGolden(t *testing.T) {
+	address := fixtureAddress()
+	order := models.Order{
+		Order_ID: orderID,
+		User_ID: userID.Hex(),
+		Order_Cart: []models.ProductUser{fixtureCartItem()},
+		Ordered_At: fixedTime,
+		Price: 8100,
+		Discount: ptr(900),
+		Payment_Method: models.Payment{COD: true},
+		Status: models.OrderShipped,
+		Status_History: []models.StatusChange{
+			{To: models.OrderPending, Changed_At: fixedTime, Changed_By: userID.Hex()},
+			{From: models.OrderPending, To: models.OrderShipped, Changed_At: fixedTime.Add(24 * time.Hour), Changed_By: "warehouse", Note: "tracking 1Z999"},
+		},
+		Shipping_Address: &address,
+		Billing_Address: &address,
+	}
+	assertGolden(t, "order", NewOrder(order))
+
+	// Orders from before statuses and addresses existed.
+	assertGolden(t, "legacy_order", NewOrder(models.Order{
+		Order_ID: orderID,
+		User_ID: userID.Hex(),
+		Ordered_At: fixedTime,
+		Price: 4500,
+	}))
+}
+
+func TestAddressGolden(t *testing.T) {
+	assertGolden(t, "address", NewAddress(fixtureAddress()))
+	assertGolden(t, "address_minimal", NewAddress(models.Address{
+		Address_ID: addressID,
+		Recipient_Name: ptr("Grace Hopper"),
+		Street: ptr("1 Main St"),
+		City: ptr("Arlington"),
+		Region: ptr("VA"),
+		Country: ptr("US"),
+	}))
+}
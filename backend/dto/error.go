@@ -0,0 +1,26 @@
+package dto
+
+// Error is the body of every error response. Message is for people, Code a
+// stable name for programs to switch on. Details is set for errors that
+// carry more, such as the fields that failed validation.
+type Error struct {
+	Message string `json:"message"`
+	// Deprecated: Error repeats Message for clients that haven't moved to
+	// it yet, and will be dropped in the next release.
+	Error string `json:"error"`
+	Code string `json:"code"`
+	Details interface{} `json:"details,omitempty"`
+	Request_ID string `json:"request_id,omitempty"`
+}
+
+// NewError returns the body of an error response.
+func NewError(message string, code string, details interface{}) Error {
+	return Error{Message: message, Error: message, Code: code, Details: details}
+}
+
+// FieldError is one failed validation rule, named by the field's JSON name.
+type FieldError struct {
+	Field string `json:"field"`
+	Rule string `json:"rule"`
+	Message string `json:"message"`
+}
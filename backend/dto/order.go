@@ -0,0 +1,80 @@
+package dto
+
+import (
+	"time"
+
+	"github.com/GadirB/ecommerce-go/models"
+)
+
+type Payment struct {
+	Digital bool `json:"digital"`
+	COD bool `json:"cod"`
+}
+
+type StatusChange struct {
+	From models.OrderStatus `json:"from"`
+	To models.OrderStatus `json:"to"`
+	Changed_At time.Time `json:"changed_at"`
+	Changed_By string `json:"changed_by"`
+	Note string `json:"note,omitempty"`
+}
+
+func NewStatusChange(change models.StatusChange) StatusChange {
+	return StatusChange{
+		From: change.From,
+		To: change.To,
+		Changed_At: change.Changed_At,
+		Changed_By: change.Changed_By,
+		Note: change.Note,
+	}
+}
+
+type Order struct {
+	ID string `json:"_id"`
+	User_ID string `json:"user_id"`
+	Order_List []CartItem `json:"order_list"`
+	Ordered_At time.Time `json:"ordered_at"`
+	Total_Price int `json:"total_price"`
+	Discount int `json:"discount"`
+	Payment_Method Payment `json:"payment_method"`
+	Status models.OrderStatus `json:"status"`
+	Status_History []StatusChange `json:"status_history"`
+	Shipping_Address *Address `json:"shipping_address"`
+	Billing_Address *Address `json:"billing_address"`
+}
+
+// NewOrder maps an order. Orders written before statuses existed are shown
+// as pending.
+func NewOrder(order models.Order) Order {
+	status := order.Status
+	if status == "" {
+		status = models.OrderPending
+	}
+	return Order{
+		ID: order.Order_ID.Hex(),
+		User_ID: order.User_ID,
+		Order_List: NewCartItems(order.Order_Cart),
+		Ordered_At: order.Ordered_At,
+		Total_Price: order.Price,
+		Discount: Deref(order.Discount),
+		Payment_Method: Payment{Digital: order.Payment_Method.Digital, COD: order.Payment_Method.COD},
+		Status: status,
+		Status_History: mapAll(order.Status_History, NewStatusChange),
+		Shipping_Address: newOrderAddress(order.Shipping_Address),
+		Billing_Address: newOrderAddress(order.Billing_Address),
+	}
+}
+
+// newOrderAddress maps an order's address snapshot. Orders placed before
+// orders had addresses have none.
+func newOrderAddress(address *models.Address) *Address {
+	if address == nil {
+		return nil
+	}
+	mapped := NewAddress(*address)
+	return &mapped
+}
+
+func NewOrders(orders []models.Order) []Order {
+	return mapAll(orders, NewOrder)
+}
@@ -0,0 +1,155 @@
+package dto
+
+import (
+	"time"
+
+	"github.com/GadirB/ecommerce-go/database"
+	"github.com/GadirB/ecommerce-go/models"
+)
+
+// Product is a product as customers see it.
+type Product struct {
+	ID string `json:"_id"`
+	Product_Name string `json:"product_name"`
+	Price uint64 `json:"price"`
+	Rating uint8 `json:"rating"`
+	Image string `json:"image"`
+	In_Stock bool `json:"in_stock"`
+}
+
+func NewProduct(product models.Product) Product {
+	return Product{
+		ID: product.Product_ID.Hex(),
+		Product_Name: Deref(product.Product_Name),
+		Price: Deref(product.Price),
+		Rating: Deref(product.Rating),
+		Image: Deref(product.Image),
+		In_Stock: product.Stock-product.Reserved > 0,
+	}
+}
+
+func NewProducts(products []models.Product) []Product {
+	return mapAll(products, NewProduct)
+}
+
+// ProductFields are the fields of Product a client can ask for, each with
+// the stored fields it is made from.
+var ProductFields = map[string][]string{
+	"_id": {"_id"},
+	"product_name": {"product_name"},
+	"price": {"price"},
+	"rating": {"rating"},
+	"image": {"image"},
+	"in_stock": {"stock", "reserved"},
+}
+
+// PartialProduct is a Product with only some of its fields, named as in
+// ProductFields. _id is always included.
+type PartialProduct map[string]interface{}
+
+func NewPartialProduct(product models.Product, fields []string) PartialProduct {
+	full := NewProduct(product)
+	partial := PartialProduct{"_id": full.ID}
+	for _, field := range fields {
+		switch field {
+		case "product_name":
+			partial[field] = full.Product_Name
+		case "price":
+			partial[field] = full.Price
+		case "rating":
+			partial[field] = full.Rating
+		case "image":
+			partial[field] = full.Image
+		case "in_stock":
+			partial[field] = full.In_Stock
+		}
+	}
+	return partial
+}
+
+func NewPartialProducts(products []models.Product, fields []string) []PartialProduct {
+	return mapAll(products, func(product models.Product) PartialProduct {
+		return NewPartialProduct(product, fields)
+	})
+}
+
+// AdminProduct is a product as staff see it, with stock and lifecycle
+// fields.
+type AdminProduct struct {
+	ID string `json:"_id"`
+	Product_Name string `json:"product_name"`
+	Price uint64 `json:"price"`
+	Rating uint8 `json:"rating"`
+	Image string `json:"image"`
+	Stock int `json:"stock"`
+	Reserved int `json:"reserved"`
+	Created_At time.Time `json:"created_at"`
+	Updated_At time.Time `json:"updated_at"`
+	Deleted_At *time.Time `json:"deleted_at,omitempty"`
+}
+
+func NewAdminProduct(product models.Product) AdminProduct {
+	return AdminProduct{
+		ID: product.Product_ID.Hex(),
+		Product_Name: Deref(product.Product_Name),
+		Price: Deref(product.Price),
+		Rating: Deref(product.Rating),
+		Image: Deref(product.Image),
+		Stock: product.Stock,
+		Reserved: product.Reserved,
+		Created_At: product.Created_At,
+		Updated_At: product.Updated_At,
+		Deleted_At: product.Deleted_At,
+	}
+}
+
+func NewAdminProducts(products []models.Product) []AdminProduct {
+	return mapAll(products, NewAdminProduct)
+}
+
+// HighlightSegment is a piece of a product name in a search result; the
+// pieces in order spell the whole name. Match marks the ones that matched
+// the search.
+type HighlightSegment struct {
+	Text string `json:"text"`
+	Match bool `json:"match"`
+}
+
+// SearchResult is a Product found by a search, with its relevance score and
+// its name split for highlighting.
+type SearchResult struct {
+	Product
+	Score float64 `json:"score"`
+	Highlight []HighlightSegment `json:"highlight"`
+}
+
+func NewSearchResult(result database.SearchResult) SearchResult {
+	product := NewProduct(result.Product)
+	return SearchResult{
+		Product: product,
+		Score: result.Score,
+		Highlight: highlight(product.Product_Name, result.Matches),
+	}
+}
+
+func NewSearchResults(results []database.SearchResult) []SearchResult {
+	return mapAll(results, NewSearchResult)
+}
+
+// highlight splits name at the edges of matches, [start, end) byte ranges
+// in order.
+func highlight(name string, matches [][2]int) []HighlightSegment {
+	segments := make([]HighlightSegment, 0, 2*len(matches)+1)
+	at := 0
+	for _, match := range matches {
+		if match[0] > at {
+			segments = append(segments, HighlightSegment{Text: name[at:match[0]]})
+		}
+		segments = append(segments, HighlightSegment{Text: name[match[0]:match[1]], Match: true})
+		at = match[1]
+	}
+	if at < len(name) {
+		segments = append(segments, HighlightSegment{Text: name[at:]})
+	}
+	return segments
+}
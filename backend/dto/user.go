@@ -0,0 +1,43 @@
+package dto
+
+import (
+	"time"
+
+	"github.com/GadirB/ecommerce-go/models"
+)
+
+// User is what the API shows of a user. It leaves out the password hash,
+// stored tokens and 2FA secrets.
+type User struct {
+	User_ID string `json:"user_id"`
+	First_Name string `json:"first_name"`
+	Last_Name string `json:"last_name"`
+	Email string `json:"email"`
+	Email_Verified bool `json:"email_verified"`
+	Pending_Email string `json:"pending_email,omitempty"`
+	Phone string `json:"phone"`
+	Roles []models.Role `json:"roles"`
+	MFA_Enabled bool `json:"mfa_enabled"`
+	Addresses []Address `json:"addresses"`
+	Created_At time.Time `json:"created_at"`
+	Updated_At time.Time `json:"updated_at"`
+}
+
+// NewUser maps a user. roles are the user's effective roles, which the
+// caller resolves.
+func NewUser(user models.User, roles []models.Role) User {
+	return User{
+		User_ID: user.User_ID,
+		First_Name: Deref(user.First_Name),
+		Last_Name: Deref(user.Last_Name),
+		Email: Deref(user.Email),
+		Email_Verified: user.Email_Verified,
+		Pending_Email: Deref(user.Pending_Email),
+		Phone: Deref(user.Phone),
+		Roles: roles,
+		MFA_Enabled: user.MFA_Enabled,
+		Addresses: NewAddresses(user.Address_Details),
+		Created_At: user.Created_At,
+		Updated_At: user.Updated_At,
+	}
+}
@@ -0,0 +1,126 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrCantSendMail = errors.New("can't send mail")
+
+type Message struct {
+	To string
+	Subject string
+	Body string
+}
+
+// Sender delivers a message. Implementations must be safe for concurrent
+// use.
+type Sender interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// Default is the sender used by the API. It is set by FromEnv at startup.
+var Default Sender = LogSender{}
+
+// FromEnv picks the sender named by MAIL_SINK: "log" (the default) writes
+// messages to the log, "file" writes each one to a file in MAIL_DIR and
+// "smtp" sends them through MAIL_SMTP_ADDR as MAIL_FROM, authenticating with
+// MAIL_SMTP_USER and MAIL_SMTP_PASSWORD when set.
+func FromEnv() (Sender, error) {
+	switch sink := os.Getenv("MAIL_SINK"); sink {
+	case "", "log":
+		return LogSender{}, nil
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "mail-out"
+		}
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+		return FileSender{Dir: dir}, nil
+	case "smtp":
+		sender := SMTPSender{
+			Addr: os.Getenv("MAIL_SMTP_ADDR"),
+			From: os.Getenv("MAIL_FROM"),
+			Username: os.Getenv("MAIL_SMTP_USER"),
+			Password: os.Getenv("MAIL_SMTP_PASSWORD"),
+		}
+		if sender.Addr == "" || sender.From == "" {
+			return nil, errors.New("MAIL_SINK=smtp needs MAIL_SMTP_ADDR and MAIL_FROM")
+		}
+		return sender, nil
+	default:
+		return nil, fmt.Errorf("unknown MAIL_SINK %q", sink)
+	}
+}
+
+func format(from string, message Message) []byte {
+	var b strings.Builder
+	if from != "" {
+		fmt.Fprintf(&b, "From: %s\r\n", from)
+	}
+	fmt.Fprintf(&b, "To: %s\r\n", message.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", message.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(message.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// LogSender writes messages to the log. It is meant for local development
+// only, as messages may carry secrets such as reset links.
+type LogSender struct{}
+
+func (LogSender) Send(ctx context.Context, message Message) error {
+	log.Printf("mail to %s: %s\n%s", message.To, message.Subject, message.Body)
+	return nil
+}
+
+// FileSender writes every message to its own file in Dir.
+type FileSender struct {
+	Dir string
+}
+
+func (s FileSender) Send(ctx context.Context, message Message) error {
+	name := fmt.Sprintf("%d.eml", time.Now().UnixNano())
+	if err := os.WriteFile(filepath.Join(s.Dir, name), format("", message), 0o600); err != nil {
+		log.Println(err)
+		return ErrCantSendMail
+	}
+	return nil
+}
+
+// SMTPSender sends messages through an SMTP relay.
+type SMTPSender struct {
+	Addr string
+	From string
+	Username string
+	Password string
+}
+
+func (s SMTPSender) Send(ctx context.Context, message Message) error {
+	if strings.ContainsAny(message.To, "\r\n") || strings.ContainsAny(message.Subject, "\r\n") {
+		return ErrCantSendMail
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, _ := net.SplitHostPort(s.Addr)
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	if err := smtp.SendMail(s.Addr, auth, s.From, []string{message.To}, format(s.From, message)); err != nil {
+		log.Println(err)
+		return ErrCantSendMail
+	}
+	return nil
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/GadirB/ecommerce-go/controllers"
 	"github.com/GadirB/ecommerce-go/database"
+	"github.com/GadirB/ecommerce-go/mail"
 	"github.com/GadirB/ecommerce-go/middleware"
+	"github.com/GadirB/ecommerce-go/models"
 	"github.com/GadirB/ecommerce-go/routes"
+	"github.com/GadirB/ecommerce-go/tokens"
 	"github.com/gin-gonic/gin"
 )
 
@@ -17,24 +24,197 @@ func main() {
 		port = "8000"
 	}
 
-	app := controllers.NewApplication(database.ProductData(database.Client, "Products"), database.UserData(database.Client, "Users"))
+	if err := tokens.LoadKeyRing(); err != nil {
+		log.Fatal(err)
+	}
+
+	sender, err := mail.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	mail.Default = sender
+
+	if value := os.Getenv("MAX_ADDRESSES"); value != "" {
+		maxAddresses, err := strconv.Atoi(value)
+		if err != nil || maxAddresses < 1 {
+			log.Fatal("MAX_ADDRESSES must be a positive number")
+		}
+		database.MaxAddresses = maxAddresses
+	}
+
+	if value := os.Getenv("DISCOUNT_PERCENT"); value != "" {
+		percent, err := strconv.Atoi(value)
+		if err != nil || percent < 1 || percent > 100 {
+			log.Fatal("DISCOUNT_PERCENT must be a number from 1 to 100")
+		}
+		minSubtotal := 0
+		if value := os.Getenv("DISCOUNT_MIN_SUBTOTAL"); value != "" {
+			if minSubtotal, err = strconv.Atoi(value); err != nil || minSubtotal < 0 {
+				log.Fatal("DISCOUNT_MIN_SUBTOTAL must be a number of at least 0")
+			}
+		}
+		database.CheckoutDiscounts = append(database.CheckoutDiscounts, database.SpendDiscount(minSubtotal, percent))
+	}
+
+	app := controllers.NewApplication(database.ProductData(database.Client, "Products"), database.UserData(database.Client, "Users"), database.OrderData(database.Client, "Orders"), database.ReservationData(database.Client, "Reservations"))
+
+	setupDatabase()
+
+	database.StartReservationReaper(context.Background(), database.ProductData(database.Client, "Products"), database.ReservationData(database.Client, "Reservations"), time.Minute)
 
 	router := gin.New()
+
+	// Login throttling counts failures per client address, so only proxies
+	// we run may set X-Forwarded-For.
+	var trustedProxies []string
+	if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+		trustedProxies = strings.Split(proxies, ",")
+	}
+	if err := router.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatal(err)
+	}
+
 	router.Use(gin.Logger())
+	router.Use(middleware.RequestID())
+	router.Use(middleware.Errors())
 	router.Use(middleware.CORS())
 
 	routes.UserRoutes(router)
+	router.GET("/.well-known/jwks.json", controllers.JWKS())
 	router.Use(middleware.Authentication())
+	router.Use(middleware.Impersonation(database.UserData(database.Client, "Users"), database.AuditData(database.Client, "AuditLog")))
+	router.Use(middleware.VerifiedEmail(database.UserData(database.Client, "Users"), os.Getenv("VERIFIED_EMAIL_ROUTES")))
 
+	router.POST("/users/logout", controllers.Logout())
+	router.POST("/users/logout/all", controllers.LogoutAll())
+	router.POST("/users/verify/resend", controllers.ResendVerification())
+	router.GET("/users/me", app.GetProfile())
+	router.PATCH("/users/me", app.UpdateProfile())
+	router.DELETE("/users/me", app.DeleteAccount())
+	router.POST("/users/me/password", app.ChangePassword())
+	router.POST("/users/me/email", app.ChangeEmail())
+	router.POST("/users/mfa/enroll", controllers.EnrollMFA())
+	router.POST("/users/mfa/confirm", controllers.ConfirmMFA())
+	router.POST("/users/mfa/disable", app.DisableMFA())
 	router.GET("/addtocart", app.AddToCart())
 	router.GET("/removeitem", app.RemoveItem())
+	router.PATCH("/cart/items/:productId", app.SetCartItemQuantity())
 	router.GET("/listcart", controllers.GetItemFromCart())
-	router.POST("/addaddress", controllers.AddAddress())
-	router.PUT("/edithomeaddress", controllers.EditHomeAddress())
-	router.PUT("/editworkaddress", controllers.EditWorkAddress())
-	router.GET("/deleteaddresses", controllers.DeleteAddress())
+	router.GET("/addresses", app.ListAddresses())
+	router.POST("/addresses", app.AddAddress())
+	router.GET("/addresses/:id", app.GetAddress())
+	router.PATCH("/addresses/:id", app.UpdateAddress())
+	router.DELETE("/addresses/:id", app.DeleteAddress())
+	// Deprecated: kept for clients that haven't moved to POST /addresses.
+	router.POST("/addaddress", app.AddAddress())
 	router.GET("/cartcheckout", app.BuyFromCart())
 	router.GET("/instantbuy", app.InstantBuy())
+	router.GET("/orders", app.ListOrders())
+	router.GET("/orders/:id", app.GetOrder())
+	router.POST("/orders/:id/cancel", app.CancelOrder())
+
+	staff := []models.Role{models.RoleAdmin, models.RoleSupport, models.RoleWarehouse}
+	adminOnly := middleware.RequireRole(models.RoleAdmin)
+	fulfilment := middleware.RequireRole(models.RoleAdmin, models.RoleWarehouse)
+	supportDesk := middleware.RequireRole(models.RoleAdmin, models.RoleSupport)
+
+	admin := router.Group("/admin", middleware.RequireRole(staff...))
+	admin.PATCH("/orders/:id/status", fulfilment, app.UpdateOrderStatus())
+	admin.GET("/products", app.ListProductsAdmin())
+	admin.POST("/products", adminOnly, app.CreateProduct())
+	admin.GET("/products/:id", app.GetProductAdmin())
+	admin.PUT("/products/:id", adminOnly, app.ReplaceProduct())
+	admin.PATCH("/products/:id", adminOnly, app.PatchProduct())
+	admin.DELETE("/products/:id", adminOnly, app.DeleteProduct())
+	admin.POST("/products/:id/restore", adminOnly, app.RestoreProduct())
+	admin.PATCH("/products/:id/stock", fulfilment, app.SetProductStock())
+	admin.PUT("/users/:id/roles/:role", adminOnly, app.GrantRole())
+	admin.DELETE("/users/:id/roles/:role", adminOnly, app.RevokeRole())
+	admin.DELETE("/users/:id/lockout", supportDesk, app.UnlockAccount())
 
 	log.Fatal(router.Run(":" + port))
-}
\ No newline at end of file
+}
+
+// setupDatabase creates indexes and brings documents written by older
+// versions of the API up to the current shape.
+func setupDatabase() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	userCollection := database.UserData(database.Client, "Users")
+	productCollection := database.ProductData(database.Client, "Products")
+	orderCollection := database.OrderData(database.Client, "Orders")
+	reservationCollection := database.ReservationData(database.Client, "Reservations")
+
+	if err := database.EnsureOrderIndexes(ctx, orderCollection); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := database.MigrateEmbeddedOrders(ctx, userCollection, orderCollection); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := database.MigrateCartQuantities(ctx, userCollection); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := database.MigrateEmailVerification(ctx, userCollection); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := database.MigrateAddressPostalCodes(ctx, userCollection); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := database.MigrateAddressDefaults(ctx, userCollection); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := database.EnsureReservationIndexes(ctx, reservationCollection); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := database.MigrateProductStock(ctx, productCollection); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := database.EnsureCatalogIndexes(ctx, productCollection); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := database.EnsureSearchIndexes(ctx, productCollection); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := database.MigrateProductSearchTerms(ctx, productCollection); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := database.BootstrapAdmins(ctx, userCollection, os.Getenv("ADMIN_EMAILS")); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := database.EnsureAuditIndexes(ctx, database.AuditData(database.Client, "AuditLog")); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := tokens.EnsureRefreshTokenIndexes(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := tokens.EnsureRevocationIndexes(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := database.EnsurePasswordResetIndexes(ctx, database.PasswordResetData(database.Client, "PasswordResets")); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := database.EnsureVerificationIndexes(ctx, database.VerificationData(database.Client, "EmailVerifications")); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := database.EnsureLoginThrottleIndexes(ctx, database.LoginThrottleData(database.Client, "LoginThrottles")); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,184 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+
+	"github.com/GadirB/ecommerce-go/database"
+	"github.com/GadirB/ecommerce-go/dto"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// RequestIDHeader carries the id RequestID gives every request.
+const RequestIDHeader = "X-Request-ID"
+
+const maxRequestIDLength = 64
+
+// RequestID tags the request with an id, echoed in the X-Request-ID response
+// header, in error bodies and in logged errors so a client report can be
+// matched with the server log. An id sent by the client or a proxy in
+// X-Request-ID is kept if it is short and made of safe characters.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Request.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		c.Set("request_id", id)
+		c.Writer.Header().Set(RequestIDHeader, id)
+		c.Next()
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// kindStatus maps domain error kinds to HTTP statuses.
+var kindStatus = map[database.ErrorKind]int{
+	database.KindInternal: http.StatusInternalServerError,
+	database.KindInvalid: http.StatusBadRequest,
+	database.KindUnauthorized: http.StatusUnauthorized,
+	database.KindForbidden: http.StatusForbidden,
+	database.KindNotFound: http.StatusNotFound,
+	database.KindConflict: http.StatusConflict,
+	database.KindTooManyRequests: http.StatusTooManyRequests,
+	database.KindUnavailable: http.StatusServiceUnavailable,
+}
+
+// Errors renders the last error a handler attached with c.Error as a
+// dto.Error, unless the handler already wrote a response. Domain errors get
+// the status of their kind, validation errors a 400 listing every failed
+// field, and anything else a 500 whose cause is only logged. It also gives
+// requests that match no route the same envelope. It must run before every
+// handler that reports errors, right after RequestID.
+func Errors() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if c.Writer.Written() {
+			return
+		}
+
+		err := c.Errors.Last()
+		if err == nil {
+			switch c.Writer.Status() {
+			case http.StatusNotFound:
+				body := dto.NewError("no such endpoint", "not_found", nil)
+				body.Request_ID = c.GetString("request_id")
+				c.JSON(http.StatusNotFound, body)
+			case http.StatusMethodNotAllowed:
+				body := dto.NewError("method not allowed", "method_not_allowed", nil)
+				body.Request_ID = c.GetString("request_id")
+				c.JSON(http.StatusMethodNotAllowed, body)
+			}
+			return
+		}
+
+		status, body := renderError(err.Err)
+		if status == http.StatusInternalServerError {
+			log.Printf("request %s: %s %s: %v", c.GetString("request_id"), c.Request.Method, c.Request.URL.Path, err.Err)
+		}
+		body.Request_ID = c.GetString("request_id")
+		c.JSON(status, body)
+	}
+}
+
+// fail aborts the request with err, which Errors renders.
+func fail(c *gin.Context, err error) {
+	_ = c.Error(err)
+	c.Abort()
+}
+
+func renderError(err error) (int, dto.Error) {
+	var validationErrs validator.ValidationErrors
+	if errors.As(err, &validationErrs) {
+		fields := make([]dto.FieldError, 0, len(validationErrs))
+		for _, fieldErr := range validationErrs {
+			fields = append(fields, dto.FieldError{
+				Field: fieldErr.Field(),
+				Rule: fieldErr.Tag(),
+				Message: fieldMessage(fieldErr),
+			})
+		}
+		return http.StatusBadRequest, dto.NewError("request is not valid", "validation_failed", fields)
+	}
+
+	if domainErr, details, ok := database.AsError(err); ok {
+		status, known := kindStatus[domainErr.Kind]
+		if !known {
+			status = http.StatusInternalServerError
+		}
+		return status, dto.NewError(domainErr.Message, domainErr.Code, details)
+	}
+
+	return http.StatusInternalServerError, dto.NewError("something went wrong", "internal", nil)
+}
+
+// fieldMessage describes a failed validation rule in words.
+func fieldMessage(fieldErr validator.FieldError) string {
+	unit := ""
+	switch fieldErr.Kind() {
+	case reflect.String:
+		unit = " characters"
+	case reflect.Slice, reflect.Map, reflect.Array:
+		unit = " items"
+	}
+
+	switch fieldErr.Tag() {
+	case "required":
+		return "is required"
+	case "required_without":
+		return fmt.Sprintf("is required when %s is missing", fieldErr.Param())
+	case "email":
+		return "must be a valid email address"
+	case "min":
+		if unit != "" {
+			return fmt.Sprintf("must have at least %s%s", fieldErr.Param(), unit)
+		}
+		return fmt.Sprintf("must be at least %s", fieldErr.Param())
+	case "max":
+		if unit != "" {
+			return fmt.Sprintf("must have at most %s%s", fieldErr.Param(), unit)
+		}
+		return fmt.Sprintf("must be at most %s", fieldErr.Param())
+	case "phone":
+		return "must be a phone number"
+	case "iso3166_1_alpha2":
+		return "must be a two-letter ISO 3166 country code"
+	case "postal_code":
+		return fmt.Sprintf("is not a valid postal code for %s", fieldErr.Param())
+	case "required_in_country":
+		return fmt.Sprintf("is required for addresses in %s", fieldErr.Param())
+	case "oneof":
+		return fmt.Sprintf("must be one of: %s", fieldErr.Param())
+	default:
+		return fmt.Sprintf("must satisfy %s", fieldErr.Tag())
+	}
+}
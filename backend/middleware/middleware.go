@@ -1,10 +1,18 @@
 package middleware
 
 import (
-	"net/http"
+	"context"
+	"log"
+	"strings"
+	"time"
 
+	"github.com/GadirB/ecommerce-go/database"
+	"github.com/GadirB/ecommerce-go/models"
 	"github.com/GadirB/ecommerce-go/tokens"
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // CORS middleware
@@ -12,8 +20,9 @@ func CORS() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, token")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, token, X-Act-As-User, X-Act-As-Reason, X-Request-ID")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, Retry-After, X-Total-Count, X-Next-Cursor, Link")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, PATCH, DELETE")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -24,24 +33,213 @@ func CORS() gin.HandlerFunc {
 	}
 }
 
+var (
+	errNoToken = database.NewError(database.KindUnauthorized, "unauthenticated", "no authorization header provided")
+	errTokenRevoked = database.NewError(database.KindUnauthorized, "token_revoked", "token has been revoked")
+	errCantCheckToken = database.NewError(database.KindUnavailable, "cant_check_token", "can't verify token")
+	errForbidden = database.NewError(database.KindForbidden, "forbidden", "you don't have permission to access this resource")
+	errEmailNotVerified = database.NewError(database.KindForbidden, "email_not_verified", "verify your email address to use this endpoint")
+	errCantImpersonate = database.NewError(database.KindForbidden, "impersonation_not_allowed", "you are not allowed to act as another user")
+)
+
 func Authentication() gin.HandlerFunc{
 	return func (c *gin.Context)  {
 		ClientToken := c.Request.Header.Get("token")
 		if ClientToken == "" {
-			c.JSON(http.StatusInternalServerError, gin.H{"Error": "No authorization header provided"})
-			c.Abort()
+			fail(c, errNoToken)
 			return 
 		}
 
 		claims, err := tokens.ValidateToken(ClientToken)
-		if err != "" {
-			c.JSON(http.StatusInternalServerError, gin.H{"Error": err})
-			c.Abort()
+		if err != nil {
+			fail(c, err)
 			return 
 		}
 
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		revoked, revocationErr := tokens.IsRevoked(ctx, claims)
+		if revocationErr != nil {
+			log.Println(revocationErr)
+			fail(c, errCantCheckToken)
+			return
+		}
+		if revoked {
+			fail(c, errTokenRevoked)
+			return
+		}
+
 		c.Set("email", claims.Email)
 		c.Set("uid", claims.Uid)
+		c.Set("roles", claims.Roles)
+		c.Set("claims", claims)
+		c.Next()
+	}
+}
+
+// RequireRole lets the request through only if the token carries at least
+// one of the given roles. It must run after Authentication.
+func RequireRole(roles ...models.Role) gin.HandlerFunc {
+	allowed := make(map[models.Role]bool, len(roles))
+	for _, role := range roles {
+		allowed[role] = true
+	}
+
+	return func(c *gin.Context) {
+		granted, _ := c.Get("roles")
+		held, _ := granted.([]models.Role)
+
+		for _, role := range held {
+			if allowed[role] {
+				c.Next()
+				return
+			}
+		}
+
+		fail(c, errForbidden)
+	}
+}
+
+// DefaultVerifiedEmailRoutes are the routes VerifiedEmail guards when no
+// list is configured.
+const DefaultVerifiedEmailRoutes = "/cartcheckout,/instantbuy"
+
+// VerifiedEmail refuses requests to the given routes until the user has
+// verified their email address. routes is a comma-separated list of route
+// patterns as registered (for example /orders/:id/cancel); an entry ending
+// in * matches every route starting with it, and "none" turns the check
+// off. It must run after Authentication and Impersonation.
+func VerifiedEmail(userCollection *mongo.Collection, routes string) gin.HandlerFunc {
+	if routes == "" {
+		routes = DefaultVerifiedEmailRoutes
+	}
+
+	exact := make(map[string]bool)
+	var prefixes []string
+	for _, route := range strings.Split(routes, ",") {
+		route = strings.TrimSpace(route)
+		switch {
+		case route == "" || route == "none":
+		case strings.HasSuffix(route, "*"):
+			prefixes = append(prefixes, strings.TrimSuffix(route, "*"))
+		default:
+			exact[route] = true
+		}
+	}
+
+	guarded := func(route string) bool {
+		if exact[route] {
+			return true
+		}
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(route, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(c *gin.Context) {
+		if !guarded(c.FullPath()) {
+			c.Next()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		verified, err := database.IsEmailVerified(ctx, userCollection, c.GetString("uid"))
+		if err != nil {
+			fail(c, err)
+			return
+		}
+		if !verified {
+			fail(c, errEmailNotVerified)
+			return
+		}
+
 		c.Next()
 	}
-}
\ No newline at end of file
+}
+
+// impersonators are the roles allowed to act on behalf of another user.
+var impersonators = []models.Role{models.RoleAdmin, models.RoleSupport}
+
+// Impersonation lets support staff act as another user by sending the
+// X-Act-As-User header together with an X-Act-As-Reason. The request then
+// runs as the target user with customer rights only, and "actor_uid" holds
+// the staff member's id. Every impersonated request is written to the audit
+// log before it is handled and refused if that fails. It must run after
+// Authentication.
+func Impersonation(userCollection *mongo.Collection, auditCollection *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		targetID := c.Request.Header.Get("X-Act-As-User")
+		if targetID == "" {
+			c.Next()
+			return
+		}
+
+		granted, _ := c.Get("roles")
+		held, _ := granted.([]models.Role)
+		permitted := false
+		for _, role := range held {
+			for _, allowed := range impersonators {
+				if role == allowed {
+					permitted = true
+				}
+			}
+		}
+		if !permitted {
+			fail(c, errCantImpersonate)
+			return
+		}
+
+		reason := c.Request.Header.Get("X-Act-As-Reason")
+		if reason == "" {
+			fail(c, database.InvalidInput("X-Act-As-Reason is required when acting as another user"))
+			return
+		}
+
+		id, err := primitive.ObjectIDFromHex(targetID)
+		if err != nil {
+			fail(c, database.InvalidInput("X-Act-As-User is not a valid user id"))
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		count, err := userCollection.CountDocuments(ctx, bson.D{primitive.E{Key: "_id", Value: id}})
+		if err != nil {
+			fail(c, err)
+			return
+		}
+		if count == 0 {
+			fail(c, database.ErrUserIdIsNotValid)
+			return
+		}
+
+		actorID := c.GetString("uid")
+		err = database.RecordAudit(ctx, auditCollection, models.AuditEntry{
+			Audit_ID: primitive.NewObjectID(),
+			Action: "impersonate",
+			Actor_ID: actorID,
+			Target_ID: targetID,
+			Reason: reason,
+			Method: c.Request.Method,
+			Path: c.Request.URL.Path,
+			Client_IP: c.ClientIP(),
+			At: time.Now(),
+		})
+		if err != nil {
+			fail(c, err)
+			return
+		}
+
+		c.Set("actor_uid", actorID)
+		c.Set("uid", targetID)
+		c.Set("roles", []models.Role{models.RoleCustomer})
+		c.Next()
+	}
+}
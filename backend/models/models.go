@@ -11,6 +11,9 @@ type User struct{
 	Last_Name *string `json:"last_name" validate:"required,min=2,max=30"`
 	Password *string `json:"password" validate:"required,min=6"`
 	Email *string `json:"email" validate:"required,email"`
+	Email_Verified bool `json:"email_verified" bson:"email_verified"`
+	Email_Verified_At *time.Time `json:"email_verified_at,omitempty" bson:"email_verified_at,omitempty"`
+	Pending_Email *string `json:"pending_email,omitempty" bson:"pending_email,omitempty"`
 	Phone *string `json:"phone" validate:"required"`
 	Token *string `json:"token"`
 	Refresh_Token *string `json:"refresh_token"`
@@ -19,15 +22,35 @@ type User struct{
 	User_ID string `json:"user_id"`
 	UserCart []ProductUser `json:"usercart" bson:"usercart"`
 	Address_Details []Address `json:"address" bson:"address"`
-	Order_Status []Order `json:"order_status" bson:"orders"`
+	Roles []Role `json:"roles" bson:"roles"`
+	MFA_Enabled bool `json:"mfa_enabled" bson:"mfa_enabled"`
+	MFA_Secret string `json:"-" bson:"mfa_secret,omitempty"`
+	MFA_Pending_Secret string `json:"-" bson:"mfa_pending_secret,omitempty"`
+	MFA_Last_Step int64 `json:"-" bson:"mfa_last_step,omitempty"`
+	MFA_Recovery_Codes []string `json:"-" bson:"mfa_recovery_codes,omitempty"`
 }
 
+type Role string
+
+const (
+	RoleCustomer Role = "customer"
+	RoleAdmin Role = "admin"
+	RoleSupport Role = "support"
+	RoleWarehouse Role = "warehouse"
+)
+
 type Product struct{
 	Product_ID primitive.ObjectID `bson:"_id"`
-	Product_Name *string `json:"product_name"`
-	Price *uint64 `json:"price"`
-	Rating *uint8 `json:"rating"`
-	Image *string `json:"image"`
+	Product_Name *string `json:"product_name" validate:"required,min=2,max=200"`
+	Price *uint64 `json:"price" validate:"required"`
+	Rating *uint8 `json:"rating" validate:"omitempty,max=5"`
+	Image *string `json:"image" validate:"omitempty,max=2048"`
+	Stock int `json:"stock" bson:"stock" validate:"min=0"`
+	Reserved int `json:"reserved" bson:"reserved"`
+	Created_At time.Time `json:"created_at" bson:"created_at"`
+	Updated_At time.Time `json:"updated_at" bson:"updated_at"`
+	Deleted_At *time.Time `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"`
+	Search_Terms []string `json:"-" bson:"search_terms"`
 }
 
 type ProductUser struct{
@@ -36,23 +59,130 @@ type ProductUser struct{
 	Price int `json:"price" bson:"price"`
 	Rating *uint `json:"rating" bson:"rating"`
 	Image *string `json:"image" bson:"image"`
+	Quantity int `json:"quantity" bson:"quantity"`
+}
+
+type Reservation struct{
+	Reservation_ID primitive.ObjectID `json:"_id" bson:"_id,omitempty"`
+	User_ID string `json:"user_id" bson:"user_id"`
+	Product_ID primitive.ObjectID `json:"product_id" bson:"product_id"`
+	Quantity int `json:"quantity" bson:"quantity"`
+	Expires_At time.Time `json:"expires_at" bson:"expires_at"`
+}
+
+type RefreshToken struct{
+	Token_ID string `json:"_id" bson:"_id"`
+	Family_ID string `json:"family_id" bson:"family_id"`
+	User_ID string `json:"user_id" bson:"user_id"`
+	Issued_At time.Time `json:"issued_at" bson:"issued_at"`
+	Expires_At time.Time `json:"expires_at" bson:"expires_at"`
+	Rotated_At *time.Time `json:"rotated_at,omitempty" bson:"rotated_at,omitempty"`
+	Revoked_At *time.Time `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+}
+
+type RevokedToken struct{
+	Revocation_ID string `json:"_id" bson:"_id,omitempty"`
+	User_ID string `json:"user_id" bson:"user_id"`
+	Revoked_At time.Time `json:"revoked_at" bson:"revoked_at"`
+	Revoked_Before *time.Time `json:"revoked_before,omitempty" bson:"revoked_before,omitempty"`
+	Expires_At time.Time `json:"expires_at" bson:"expires_at"`
+}
+
+// PasswordReset is a pending password reset. Only the SHA-256 hash of the
+// token mailed to the user is stored.
+type PasswordReset struct{
+	Reset_ID primitive.ObjectID `json:"_id" bson:"_id"`
+	User_ID string `json:"user_id" bson:"user_id"`
+	Token_Hash string `json:"-" bson:"token_hash"`
+	Created_At time.Time `json:"created_at" bson:"created_at"`
+	Expires_At time.Time `json:"expires_at" bson:"expires_at"`
+	Used_At *time.Time `json:"used_at,omitempty" bson:"used_at,omitempty"`
 }
 
+// EmailVerification proves a user owns Email. Only the SHA-256 hash of the
+// token mailed to them is stored.
+type EmailVerification struct{
+	Verification_ID primitive.ObjectID `json:"_id" bson:"_id"`
+	User_ID string `json:"user_id" bson:"user_id"`
+	Email string `json:"email" bson:"email"`
+	Token_Hash string `json:"-" bson:"token_hash"`
+	Created_At time.Time `json:"created_at" bson:"created_at"`
+	Expires_At time.Time `json:"expires_at" bson:"expires_at"`
+}
+
+// LoginThrottle counts recent failed logins for one account or one client
+// address. Throttle_ID is "account:<email>" or "ip:<address>".
+type LoginThrottle struct{
+	Throttle_ID string `json:"_id" bson:"_id"`
+	Failures int `json:"failures" bson:"failures"`
+	Last_Failure_At time.Time `json:"last_failure_at" bson:"last_failure_at"`
+	Locked_Until *time.Time `json:"locked_until,omitempty" bson:"locked_until,omitempty"`
+	Expires_At time.Time `json:"expires_at" bson:"expires_at"`
+}
+
+type AuditEntry struct{
+	Audit_ID primitive.ObjectID `json:"_id" bson:"_id"`
+	Action string `json:"action" bson:"action"`
+	Actor_ID string `json:"actor_id" bson:"actor_id"`
+	Target_ID string `json:"target_id" bson:"target_id"`
+	Reason string `json:"reason" bson:"reason"`
+	Method string `json:"method" bson:"method"`
+	Path string `json:"path" bson:"path"`
+	Client_IP string `json:"client_ip" bson:"client_ip"`
+	At time.Time `json:"at" bson:"at"`
+}
+
+// Address is one entry of a user's address book. Label is the user's own
+// name for it, such as "home" or "work". Country is an ISO 3166-1 alpha-2
+// code; which of Region and Postal_Code are required depends on it.
 type Address struct{
-	Address_ID primitive.ObjectID `bson:"_id"`
-	House *string `json:"house_name" bson:"house_name"`
-	Street *string `json:"street_name" bson:"street_name"`
-	City *string `json:"city_name" bson:"city_name"`
-	Pincode *string `json:"pin_code" bson:"pin_code"`
+	Address_ID primitive.ObjectID `json:"_id" bson:"_id"`
+	Label *string `json:"label" bson:"label,omitempty" validate:"omitnil,max=40"`
+	Recipient_Name *string `json:"recipient_name" bson:"recipient_name" validate:"required,min=1,max=100"`
+	Phone *string `json:"phone" bson:"phone,omitempty" validate:"omitnil,phone"`
+	House *string `json:"house_name" bson:"house_name" validate:"omitnil,max=100"`
+	Street *string `json:"street_name" bson:"street_name" validate:"required,min=1,max=200"`
+	Line_2 *string `json:"line_2" bson:"line_2,omitempty" validate:"omitnil,max=200"`
+	City *string `json:"city_name" bson:"city_name" validate:"required,min=1,max=100"`
+	Region *string `json:"region" bson:"region,omitempty" validate:"omitnil,max=100"`
+	Postal_Code *string `json:"postal_code" bson:"postal_code" validate:"omitnil,max=20"`
+	Country *string `json:"country" bson:"country" validate:"required,iso3166_1_alpha2"`
+	Default_Shipping bool `json:"default_shipping" bson:"default_shipping"`
+	Default_Billing bool `json:"default_billing" bson:"default_billing"`
 }
 
 type Order struct{
-	Order_ID primitive.ObjectID `bson:"_id"`
+	Order_ID primitive.ObjectID `json:"_id" bson:"_id"`
+	User_ID string `json:"user_id" bson:"user_id"`
 	Order_Cart []ProductUser `json:"order_list" bson:"order_list"`
 	Ordered_At time.Time `json:"ordered_at" bson:"ordered_at"`
 	Price int `json:"total_price" bson:"total_price"`
 	Discount *int `json:"discount" bson:"discount"`
 	Payment_Method Payment `json:"payment_method" bson:"payment_method"`
+	Status OrderStatus `json:"status" bson:"status"`
+	Status_History []StatusChange `json:"status_history" bson:"status_history"`
+	Shipping_Address *Address `json:"shipping_address" bson:"shipping_address,omitempty"`
+	Billing_Address *Address `json:"billing_address" bson:"billing_address,omitempty"`
+}
+
+type OrderStatus string
+
+const (
+	OrderPending OrderStatus = "pending"
+	OrderPaid OrderStatus = "paid"
+	OrderPacked OrderStatus = "packed"
+	OrderShipped OrderStatus = "shipped"
+	OrderDelivered OrderStatus = "delivered"
+	OrderCancelled OrderStatus = "cancelled"
+	OrderRefunded OrderStatus = "refunded"
+)
+
+type StatusChange struct{
+	From OrderStatus `json:"from" bson:"from"`
+	To OrderStatus `json:"to" bson:"to"`
+	Changed_At time.Time `json:"changed_at" bson:"changed_at"`
+	Changed_By string `json:"changed_by" bson:"changed_by"`
+	Note string `json:"note,omitempty" bson:"note,omitempty"`
 }
 
 type Payment struct{
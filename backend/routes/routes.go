@@ -8,7 +8,11 @@ import (
 func UserRoutes(incomingRoutes *gin.Engine) {
 	incomingRoutes.POST("/users/signup", controllers.SignUp())
 	incomingRoutes.POST("/users/login", controllers.Login())
-	incomingRoutes.POST("/admin/addproduct", controllers.ProductViewerAdmin())
+	incomingRoutes.POST("/users/login/mfa", controllers.LoginMFA())
+	incomingRoutes.POST("/users/refresh", controllers.RefreshToken())
+	incomingRoutes.POST("/users/password/forgot", controllers.ForgotPassword())
+	incomingRoutes.POST("/users/password/reset", controllers.ResetPassword())
+	incomingRoutes.GET("/users/verify", controllers.VerifyEmail())
 	incomingRoutes.GET("/users/productview", controllers.SearchProduct())
 	incomingRoutes.GET("/users/search", controllers.SearchProductByQuery())
 }
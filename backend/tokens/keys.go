@@ -0,0 +1,294 @@
+package tokens
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrNoSigningKey = errors.New("no JWT signing key configured: set JWT_KEYS or SECRET_KEY")
+	ErrUnknownSigningKey = errors.New("token is signed with an unknown key")
+	ErrUnexpectedAlgorithm = errors.New("token is signed with an unexpected algorithm")
+)
+
+// secretKeyID is the kid of the HMAC key built from SECRET_KEY.
+const secretKeyID = "secret"
+
+const minRSAKeyBits = 2048
+
+// Keys is the key ring tokens are signed and verified with. It is set by
+// LoadKeyRing at startup.
+var Keys *KeyRing
+
+// SigningKey is one key of the ring. Keys loaded from a public key file can
+// only verify.
+type SigningKey struct {
+	ID string
+	Method jwt.SigningMethod
+	signer interface{}
+	verifier interface{}
+}
+
+// KeyRing holds the key new tokens are signed with and every key tokens are
+// still accepted from. Rotating keys takes three deploys: add the new key
+// after the current one so it is published in the JWKS, move it to the
+// front so it signs, and drop the old key once the tokens it signed have
+// expired.
+type KeyRing struct {
+	active *SigningKey
+	keys map[string]*SigningKey
+	order []string
+}
+
+// LoadKeyRing builds Keys from the environment. JWT_KEYS is a comma-separated
+// list of kid=path pairs naming PEM files; the first one must be a private
+// key and signs new tokens. SECRET_KEY, if set, adds an HMAC key that signs
+// only when JWT_KEYS is empty and otherwise just verifies, so tokens issued
+// before a switch to asymmetric keys keep working. JWT_ISSUER and
+// JWT_AUDIENCE override the default iss and aud claims.
+func LoadKeyRing() error {
+	ring, err := NewKeyRing(os.Getenv("JWT_KEYS"), os.Getenv("SECRET_KEY"))
+	if err != nil {
+		return err
+	}
+	Keys = ring
+
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		Issuer = issuer
+	}
+	if audience := os.Getenv("JWT_AUDIENCE"); audience != "" {
+		Audience = audience
+	}
+	return nil
+}
+
+func NewKeyRing(keySpecs string, secret string) (*KeyRing, error) {
+	ring := &KeyRing{keys: make(map[string]*SigningKey)}
+
+	for _, spec := range strings.Split(keySpecs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		id, path, found := strings.Cut(spec, "=")
+		if !found || id == "" || path == "" {
+			return nil, fmt.Errorf("JWT_KEYS entry %q must look like kid=path", spec)
+		}
+		if id == secretKeyID {
+			return nil, fmt.Errorf("JWT_KEYS: kid %q is reserved", id)
+		}
+		if _, exists := ring.keys[id]; exists {
+			return nil, fmt.Errorf("JWT_KEYS: kid %q is used twice", id)
+		}
+
+		key, err := loadKeyFile(id, path)
+		if err != nil {
+			return nil, err
+		}
+
+		if ring.active == nil {
+			if key.signer == nil {
+				return nil, fmt.Errorf("JWT_KEYS: the first key (%q) signs tokens and must be a private key", id)
+			}
+			ring.active = key
+		}
+		ring.keys[id] = key
+		ring.order = append(ring.order, id)
+	}
+
+	if secret != "" {
+		key := &SigningKey{ID: secretKeyID, Method: jwt.SigningMethodHS256, signer: []byte(secret), verifier: []byte(secret)}
+		ring.keys[secretKeyID] = key
+		ring.order = append(ring.order, secretKeyID)
+		if ring.active == nil {
+			ring.active = key
+		}
+	}
+
+	if ring.active == nil {
+		return nil, ErrNoSigningKey
+	}
+
+	return ring, nil
+}
+
+func loadKeyFile(id string, path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("JWT key %q: %w", id, err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("JWT key %q: %s is not a PEM file", id, path)
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("JWT key %q: unsupported PEM block %q", id, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("JWT key %q: %w", id, err)
+	}
+
+	return newSigningKey(id, parsed)
+}
+
+// newSigningKey picks the algorithm from the key type: RS256 for RSA, ES256,
+// ES384 or ES512 for ECDSA depending on the curve, and EdDSA for Ed25519.
+func newSigningKey(id string, parsed interface{}) (*SigningKey, error) {
+	key := &SigningKey{ID: id}
+
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.signer, key.verifier = k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.verifier = k
+	case *ecdsa.PrivateKey:
+		key.signer, key.verifier = k, &k.PublicKey
+	case *ecdsa.PublicKey:
+		key.verifier = k
+	case ed25519.PrivateKey:
+		key.signer, key.verifier = k, k.Public()
+	case ed25519.PublicKey:
+		key.verifier = k
+	default:
+		return nil, fmt.Errorf("JWT key %q: unsupported key type %T", id, parsed)
+	}
+
+	switch k := key.verifier.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("JWT key %q: RSA keys must be at least %d bits", id, minRSAKeyBits)
+		}
+		key.Method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			key.Method = jwt.SigningMethodES256
+		case elliptic.P384():
+			key.Method = jwt.SigningMethodES384
+		case elliptic.P521():
+			key.Method = jwt.SigningMethodES512
+		default:
+			return nil, fmt.Errorf("JWT key %q: unsupported elliptic curve", id)
+		}
+	case ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+	}
+
+	return key, nil
+}
+
+// sign signs claims with the active key and names it in the kid header.
+func (r *KeyRing) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(r.active.Method, claims)
+	token.Header["kid"] = r.active.ID
+	return token.SignedString(r.active.signer)
+}
+
+// verificationKey is the jwt.Keyfunc for tokens signed by the ring. The
+// algorithm is pinned to the key named in the kid header, so a token can't
+// pick how it is checked.
+func (r *KeyRing) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := r.keys[kid]
+	if !ok {
+		return nil, ErrUnknownSigningKey
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, ErrUnexpectedAlgorithm
+	}
+	return key.verifier, nil
+}
+
+// methods lists the algorithms of the ring's keys, the only ones a token
+// may be signed with.
+func (r *KeyRing) methods() []string {
+	var methods []string
+	seen := make(map[string]bool)
+	for _, id := range r.order {
+		alg := r.keys[id].Method.Alg()
+		if !seen[alg] {
+			seen[alg] = true
+			methods = append(methods, alg)
+		}
+	}
+	return methods
+}
+
+// JSONWebKey is the public part of a ring key in RFC 7517 form.
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X string `json:"x,omitempty"`
+	Y string `json:"y,omitempty"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JWKS publishes the public keys of the ring. HMAC keys are secret and left
+// out.
+func (r *KeyRing) JWKS() JSONWebKeySet {
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	encode := base64.RawURLEncoding.EncodeToString
+
+	for _, id := range r.order {
+		key := r.keys[id]
+		jwk := JSONWebKey{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+
+		switch k := key.verifier.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = encode(k.N.Bytes())
+			jwk.E = encode(big.NewInt(int64(k.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (k.Curve.Params().BitSize + 7) / 8
+			jwk.Kty = "EC"
+			jwk.Crv = k.Curve.Params().Name
+			jwk.X = encode(k.X.FillBytes(make([]byte, size)))
+			jwk.Y = encode(k.Y.FillBytes(make([]byte, size)))
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = encode(k)
+		default:
+			continue
+		}
+
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	return set
+}
@@ -0,0 +1,148 @@
+package tokens
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/GadirB/ecommerce-go/database"
+	"github.com/GadirB/ecommerce-go/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrRefreshTokenInvalid = database.NewError(database.KindUnauthorized, "refresh_token_invalid", "refresh token is invalid")
+	ErrRefreshTokenReused = database.NewError(database.KindUnauthorized, "refresh_token_reused", "refresh token was already used; all sessions from that login have been revoked")
+	ErrCantStoreRefreshToken = database.NewError(database.KindInternal, "cant_store_refresh_token", "can't store refresh token")
+)
+
+var RefreshTokenData *mongo.Collection = database.RefreshTokenData(database.Client, "RefreshTokens")
+
+// EnsureRefreshTokenIndexes creates the family lookup index and a TTL index
+// that drops refresh token records once the tokens have expired.
+func EnsureRefreshTokenIndexes(ctx context.Context) error {
+	_, err := RefreshTokenData.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "family_id", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{
+			Keys: bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+func recordRefreshToken(ctx context.Context, tokenID string, family string, uid string, issuedAt time.Time, expiresAt time.Time) error {
+	_, err := RefreshTokenData.InsertOne(ctx, models.RefreshToken{
+		Token_ID: tokenID,
+		Family_ID: family,
+		User_ID: uid,
+		Issued_At: issuedAt,
+		Expires_At: expiresAt,
+	})
+	if err != nil {
+		log.Println(err)
+		return ErrCantStoreRefreshToken
+	}
+	return nil
+}
+
+func parseRefreshToken(signedRefreshToken string) (*SignedDetails, error) {
+	claims, err := parseToken(signedRefreshToken, RefreshToken)
+	if err != nil || claims.Family == "" {
+		return nil, ErrRefreshTokenInvalid
+	}
+	return claims, nil
+}
+
+// errAlreadyRotated aborts a refresh whose token was already used.
+var errAlreadyRotated = errors.New("refresh token already rotated")
+
+// RefreshTokens exchanges a refresh token for a new access/refresh pair.
+// Every refresh token can be used once: it is marked rotated in the same
+// transaction that stores its successor, so a failed refresh leaves it
+// usable for a retry. Presenting a rotated token again means it has leaked,
+// so the whole family descending from that login is revoked, along with the
+// access tokens issued from it.
+func RefreshTokens(ctx context.Context, signedRefreshToken string) (signedToken string, newRefreshToken string, err error) {
+	claims, err := parseRefreshToken(signedRefreshToken)
+	if err != nil {
+		return "", "", err
+	}
+
+	id, err := primitive.ObjectIDFromHex(claims.Uid)
+	if err != nil {
+		return "", "", ErrRefreshTokenInvalid
+	}
+
+	session, err := RefreshTokenData.Database().Client().StartSession()
+	if err != nil {
+		log.Println(err)
+		return "", "", ErrCantStoreRefreshToken
+	}
+	defer session.EndSession(ctx)
+
+	var user models.User
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		filter := bson.D{
+			primitive.E{Key: "_id", Value: claims.ID},
+			{Key: "user_id", Value: claims.Uid},
+			{Key: "rotated_at", Value: nil},
+			{Key: "revoked_at", Value: nil},
+		}
+		update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "rotated_at", Value: time.Now()}}}}
+
+		result, err := RefreshTokenData.UpdateOne(sc, filter, update)
+		if err != nil {
+			return nil, err
+		}
+		if result.MatchedCount == 0 {
+			return nil, errAlreadyRotated
+		}
+
+		if err = UserData.FindOne(sc, bson.D{primitive.E{Key: "_id", Value: id}}).Decode(&user); err != nil {
+			return nil, ErrRefreshTokenInvalid
+		}
+
+		signedToken, newRefreshToken, err = issueTokens(sc, *user.Email, *user.First_Name, *user.Last_Name, user.User_ID, database.EffectiveRoles(user), claims.Auth_Methods, claims.Family)
+		return nil, err
+	})
+	switch {
+	case err == nil:
+	case errors.Is(err, errAlreadyRotated):
+		var stored models.RefreshToken
+		err = RefreshTokenData.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: claims.ID}}).Decode(&stored)
+		if err == nil && stored.Rotated_At != nil && stored.Revoked_At == nil {
+			if revokeErr := RevokeTokenFamily(ctx, stored.Family_ID); revokeErr != nil {
+				log.Println(revokeErr)
+			}
+			if revokeErr := RevokeFamilyAccessTokens(ctx, stored.User_ID, stored.Family_ID); revokeErr != nil {
+				log.Println(revokeErr)
+			}
+			log.Printf("refresh token reuse detected for user %s, family %s revoked", stored.User_ID, stored.Family_ID)
+			return "", "", ErrRefreshTokenReused
+		}
+		return "", "", ErrRefreshTokenInvalid
+	case errors.Is(err, ErrRefreshTokenInvalid), errors.Is(err, ErrCantStoreRefreshToken):
+		return "", "", err
+	default:
+		log.Println(err)
+		return "", "", ErrCantStoreRefreshToken
+	}
+
+	UpdateAllTokens(signedToken, newRefreshToken, user.User_ID)
+
+	return signedToken, newRefreshToken, nil
+}
+
+// RevokeTokenFamily revokes every refresh token issued from one login.
+func RevokeTokenFamily(ctx context.Context, family string) error {
+	filter := bson.D{primitive.E{Key: "family_id", Value: family}, {Key: "revoked_at", Value: nil}}
+	update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "revoked_at", Value: time.Now()}}}}
+	_, err := RefreshTokenData.UpdateMany(ctx, filter, update)
+	return err
+}
@@ -0,0 +1,225 @@
+package tokens
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/GadirB/ecommerce-go/database"
+	"github.com/GadirB/ecommerce-go/models"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrCantRevokeToken = database.NewError(database.KindInternal, "cant_revoke_token", "can't revoke token")
+
+var RevocationData *mongo.Collection = database.RevocationData(database.Client, "RevokedTokens")
+
+// RevocationCacheTTL bounds how long a "not revoked" answer is trusted
+// before the store is asked again, and so how long a revocation made by
+// another instance can take to be noticed here. Revocations made by this
+// instance apply immediately.
+var RevocationCacheTTL = 30 * time.Second
+
+// userRevocationPrefix marks the store entry holding a user's "log out
+// everywhere" cut-off, and familyRevocationPrefix the entry revoking the
+// access tokens of one refresh token family, as opposed to a single revoked
+// token id.
+const (
+	userRevocationPrefix = "user:"
+	familyRevocationPrefix = "family:"
+)
+
+type revocationEntry struct {
+	uid string
+	revoked bool
+	until time.Time
+}
+
+var revocationCache = struct {
+	sync.Mutex
+	entries map[string]revocationEntry
+}{entries: make(map[string]revocationEntry)}
+
+func cacheRevocation(key string, uid string, revoked bool, until time.Time) {
+	revocationCache.Lock()
+	defer revocationCache.Unlock()
+
+	now := time.Now()
+	if len(revocationCache.entries) > 10000 {
+		for k, entry := range revocationCache.entries {
+			if now.After(entry.until) {
+				delete(revocationCache.entries, k)
+			}
+		}
+	}
+	revocationCache.entries[key] = revocationEntry{uid: uid, revoked: revoked, until: until}
+}
+
+func cachedRevocation(key string) (revocationEntry, bool) {
+	revocationCache.Lock()
+	defer revocationCache.Unlock()
+
+	entry, ok := revocationCache.entries[key]
+	if !ok || time.Now().After(entry.until) {
+		return revocationEntry{}, false
+	}
+	return entry, true
+}
+
+// EnsureRevocationIndexes creates the TTL index that drops revocation
+// entries once the tokens they cover would have expired anyway.
+func EnsureRevocationIndexes(ctx context.Context) error {
+	_, err := RevocationData.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// RevokeAccessToken denylists a single access token until it expires.
+func RevokeAccessToken(ctx context.Context, claims *SignedDetails) error {
+	expiresAt := claims.ExpiresAt.Time
+	filter := bson.D{primitive.E{Key: "_id", Value: claims.ID}}
+	update := bson.D{{Key: "$set", Value: models.RevokedToken{
+		User_ID: claims.Uid,
+		Revoked_At: time.Now(),
+		Expires_At: expiresAt,
+	}}}
+
+	if _, err := RevocationData.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true)); err != nil {
+		log.Println(err)
+		return ErrCantRevokeToken
+	}
+
+	cacheRevocation(claims.ID, claims.Uid, true, expiresAt)
+	return nil
+}
+
+// RevokeAllUserTokens logs a user out everywhere: every access token issued
+// to them up to now stops working and all their refresh token families are
+// revoked.
+func RevokeAllUserTokens(ctx context.Context, uid string) error {
+	// Truncated like the issue times of tokens, so one issued right after
+	// the cut-off is never compared against a later instant.
+	now := time.Now().Truncate(jwt.TimePrecision)
+	key := userRevocationPrefix + uid
+	expiresAt := now.Add(accessTokenLifetime)
+
+	filter := bson.D{primitive.E{Key: "_id", Value: key}}
+	update := bson.D{{Key: "$set", Value: models.RevokedToken{
+		User_ID: uid,
+		Revoked_At: now,
+		Revoked_Before: &now,
+		Expires_At: expiresAt,
+	}}}
+
+	if _, err := RevocationData.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true)); err != nil {
+		log.Println(err)
+		return ErrCantRevokeToken
+	}
+
+	familyFilter := bson.D{primitive.E{Key: "user_id", Value: uid}, {Key: "revoked_at", Value: nil}}
+	familyUpdate := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "revoked_at", Value: now}}}}
+	if _, err := RefreshTokenData.UpdateMany(ctx, familyFilter, familyUpdate); err != nil {
+		log.Println(err)
+		return ErrCantRevokeToken
+	}
+
+	forgetRevocations(uid)
+	return nil
+}
+
+// RevokeFamilyAccessTokens stops every access token issued from one refresh
+// token family from working, for when the family is revoked because one of
+// its refresh tokens leaked.
+func RevokeFamilyAccessTokens(ctx context.Context, uid string, family string) error {
+	now := time.Now()
+	filter := bson.D{primitive.E{Key: "_id", Value: familyRevocationPrefix + family}}
+	update := bson.D{{Key: "$set", Value: models.RevokedToken{
+		User_ID: uid,
+		Revoked_At: now,
+		Expires_At: now.Add(accessTokenLifetime),
+	}}}
+
+	if _, err := RevocationData.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true)); err != nil {
+		log.Println(err)
+		return ErrCantRevokeToken
+	}
+
+	forgetRevocations(uid)
+	return nil
+}
+
+// forgetRevocations drops the cached answers for the user's tokens, so a
+// revocation made here applies immediately.
+func forgetRevocations(uid string) {
+	revocationCache.Lock()
+	defer revocationCache.Unlock()
+	for k, entry := range revocationCache.entries {
+		if entry.uid == uid {
+			delete(revocationCache.entries, k)
+		}
+	}
+}
+
+// RevokeRefreshToken revokes the family of the given refresh token, so the
+// session it belongs to can't be renewed. Invalid tokens are ignored.
+func RevokeRefreshToken(ctx context.Context, signedRefreshToken string) error {
+	claims, err := parseRefreshToken(signedRefreshToken)
+	if err != nil {
+		return nil
+	}
+	if err = RevokeTokenFamily(ctx, claims.Family); err != nil {
+		log.Println(err)
+		return ErrCantRevokeToken
+	}
+	return nil
+}
+
+// IsRevoked reports whether an otherwise valid access token has been
+// revoked, either on its own, with its refresh token family or by its user
+// logging out everywhere.
+func IsRevoked(ctx context.Context, claims *SignedDetails) (bool, error) {
+	cacheKey := claims.ID
+	if entry, ok := cachedRevocation(cacheKey); ok {
+		return entry.revoked, nil
+	}
+
+	ids := bson.A{userRevocationPrefix + claims.Uid, claims.ID}
+	if claims.Family != "" {
+		ids = append(ids, familyRevocationPrefix+claims.Family)
+	}
+
+	cursor, err := RevocationData.Find(ctx, bson.D{primitive.E{Key: "_id", Value: bson.D{primitive.E{Key: "$in", Value: ids}}}})
+	if err != nil {
+		return false, err
+	}
+
+	var entries []models.RevokedToken
+	if err = cursor.All(ctx, &entries); err != nil {
+		return false, err
+	}
+
+	revoked := false
+	for _, entry := range entries {
+		if entry.Revocation_ID == claims.ID || (claims.Family != "" && entry.Revocation_ID == familyRevocationPrefix+claims.Family) {
+			revoked = true
+		}
+		if entry.Revoked_Before != nil && claims.IssuedAt.Before(*entry.Revoked_Before) {
+			revoked = true
+		}
+	}
+
+	if revoked {
+		cacheRevocation(cacheKey, claims.Uid, true, claims.ExpiresAt.Time)
+	} else {
+		cacheRevocation(cacheKey, claims.Uid, false, time.Now().Add(RevocationCacheTTL))
+	}
+
+	return revoked, nil
+}
@@ -2,12 +2,14 @@ package tokens
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
-	"os"
 	"time"
 
 	"github.com/GadirB/ecommerce-go/database"
-	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/GadirB/ecommerce-go/models"
+	"github.com/golang-jwt/jwt/v5"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -19,68 +21,181 @@ type SignedDetails struct{
 	First_Name string
 	Last_Name string
 	Uid string
-	jwt.StandardClaims
+	Roles []models.Role
+	Token_Type string
+	Family string
+	Auth_Methods []string
+	jwt.RegisteredClaims
 }
 
 var UserData *mongo.Collection = database.UserData(database.Client, "Users")
 
-var SECRET_KEY = os.Getenv("SECRET_KEY")
+// Issuer and Audience are written to every token and required when one is
+// validated. LoadKeyRing overrides them from JWT_ISSUER and JWT_AUDIENCE.
+var (
+	Issuer = "ecommerce-go"
+	Audience = "ecommerce-go"
+)
+
+// ClockSkew is how far exp, nbf and iat may be off to allow for clocks of
+// different servers drifting apart.
+var ClockSkew = 30 * time.Second
+
+// ValidateToken errors. The error returned wraps one of these together with
+// the underlying reason.
+var (
+	ErrTokenMalformed = database.NewError(database.KindUnauthorized, "token_malformed", "token is malformed")
+	ErrTokenExpired = database.NewError(database.KindUnauthorized, "token_expired", "token has expired")
+	ErrTokenNotValidYet = database.NewError(database.KindUnauthorized, "token_not_valid_yet", "token is not valid yet")
+	ErrTokenInvalid = database.NewError(database.KindUnauthorized, "token_invalid", "token is invalid")
+)
+
+// Token_Type values. An MFA pending token proves the password was right and
+// can only be exchanged for real tokens together with a second factor.
+const (
+	AccessToken = "access"
+	RefreshToken = "refresh"
+	MFAPendingToken = "mfa_pending"
+)
+
+// Auth_Methods values, after the "amr" values of RFC 8176.
+const (
+	AuthPassword = "pwd"
+	AuthOTP = "otp"
+	AuthRecoveryCode = "rec"
+)
+
+// Token times are written with millisecond precision, the precision the
+// revocation store keeps its cut-offs at, so a log-out-everywhere cut-off
+// tells apart tokens issued in the same second.
+func init() {
+	jwt.TimePrecision = time.Millisecond
+}
+
+const (
+	accessTokenLifetime = 24 * time.Hour
+	refreshTokenLifetime = 168 * time.Hour
+	mfaPendingTokenLifetime = 5 * time.Minute
+)
+
+// TokenGenerator issues an access/refresh pair for a fresh login that was
+// authenticated with authMethods. The refresh token starts a new token
+// family; see RefreshTokens.
+func TokenGenerator(email string, firstName string, lastName string, uid string, roles []models.Role, authMethods []string)(signedToken string, signedRefreshToken string, err error){
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return issueTokens(ctx, email, firstName, lastName, uid, roles, authMethods, primitive.NewObjectID().Hex())
+}
+
+func issueTokens(ctx context.Context, email string, firstName string, lastName string, uid string, roles []models.Role, authMethods []string, family string)(signedToken string, signedRefreshToken string, err error){
+	now := time.Now()
 
-func TokenGenerator(email string, firstName string, lastName string, uid string)(signedToken string, signedRefreshToken string, err error){
 	claims := &SignedDetails{
 		Email: email,
 		First_Name: firstName,
 		Last_Name: lastName,
 		Uid: uid,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Local().Add(time.Hour * time.Duration(24)).Unix(),
-		},
+		Roles: roles,
+		Token_Type: AccessToken,
+		Family: family,
+		Auth_Methods: authMethods,
+		RegisteredClaims: registeredClaims(uid, now, now.Add(accessTokenLifetime)),
 	}
 
+	refreshExpiry := now.Add(refreshTokenLifetime)
 	refreshClaims := &SignedDetails{
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Local().Add(time.Hour * time.Duration(168)).Unix(),
-		},
+		Uid: uid,
+		Token_Type: RefreshToken,
+		Family: family,
+		Auth_Methods: authMethods,
+		RegisteredClaims: registeredClaims(uid, now, refreshExpiry),
 	}
 
-	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(SECRET_KEY))
+	token, err := Keys.sign(claims)
 
 	if err != nil {
 		return "", "", err
 	}
 
-	refreshToken, err := jwt.NewWithClaims(jwt.SigningMethodHS384, refreshClaims).SignedString([]byte(SECRET_KEY))
+	refreshToken, err := Keys.sign(refreshClaims)
 
 	if err != nil {
-		log.Panic(err)
-		return
+		return "", "", err
+	}
+
+	if err = recordRefreshToken(ctx, refreshClaims.ID, family, uid, now, refreshExpiry); err != nil {
+		return "", "", err
 	}
 
 	return token, refreshToken, err
 }
 
-func ValidateToken(signedToken string) (claims *SignedDetails, msg string){
-	token, err := jwt.ParseWithClaims(signedToken, &SignedDetails{}, func (token *jwt.Token) (interface{}, error)  {
-		return []byte(SECRET_KEY), nil
+// MFAPendingTokenGenerator issues the token a user whose password checked
+// out gets when their account needs a second factor.
+func MFAPendingTokenGenerator(uid string) (string, error) {
+	now := time.Now()
+	return Keys.sign(&SignedDetails{
+		Uid: uid,
+		Token_Type: MFAPendingToken,
+		Auth_Methods: []string{AuthPassword},
+		RegisteredClaims: registeredClaims(uid, now, now.Add(mfaPendingTokenLifetime)),
 	})
+}
 
-	if err != nil {
-		msg = err.Error()
-	}
+// ValidateMFAPendingToken checks a token from MFAPendingTokenGenerator.
+func ValidateMFAPendingToken(signedToken string) (*SignedDetails, error) {
+	return parseToken(signedToken, MFAPendingToken)
+}
 
-	claims, ok := token.Claims.(*SignedDetails)
+func registeredClaims(uid string, issuedAt time.Time, expiresAt time.Time) jwt.RegisteredClaims {
+	return jwt.RegisteredClaims{
+		ID: primitive.NewObjectID().Hex(),
+		Issuer: Issuer,
+		Subject: uid,
+		Audience: jwt.ClaimStrings{Audience},
+		IssuedAt: jwt.NewNumericDate(issuedAt),
+		NotBefore: jwt.NewNumericDate(issuedAt),
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+	}
+}
 
-	if !ok {
-		msg = "The Token Is Invalid"
-		return
+// parseToken verifies the signature and registered claims of a token and
+// checks it is of the expected type.
+func parseToken(signedToken string, tokenType string) (*SignedDetails, error) {
+	parser := jwt.NewParser(
+		jwt.WithValidMethods(Keys.methods()),
+		jwt.WithIssuer(Issuer),
+		jwt.WithAudience(Audience),
+		jwt.WithIssuedAt(),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(ClockSkew),
+	)
+
+	claims := &SignedDetails{}
+	_, err := parser.ParseWithClaims(signedToken, claims, Keys.verificationKey)
+	switch {
+	case err == nil:
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return nil, fmt.Errorf("%w: %w", ErrTokenMalformed, err)
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return nil, fmt.Errorf("%w: %w", ErrTokenExpired, err)
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return nil, fmt.Errorf("%w: %w", ErrTokenNotValidYet, err)
+	default:
+		return nil, fmt.Errorf("%w: %w", ErrTokenInvalid, err)
 	}
 
-	if claims.ExpiresAt < time.Now().Unix() {
-		msg = "Token Is Already Expired"
-		return
+	if claims.Token_Type != tokenType || claims.ID == "" || claims.IssuedAt == nil || claims.Uid == "" || claims.Subject != claims.Uid {
+		return nil, ErrTokenInvalid
 	}
 
-	return claims, msg
+	return claims, nil
+}
+
+// ValidateToken checks an access token and returns its claims. Errors wrap
+// ErrTokenMalformed, ErrTokenExpired, ErrTokenNotValidYet or ErrTokenInvalid.
+func ValidateToken(signedToken string) (*SignedDetails, error) {
+	return parseToken(signedToken, AccessToken)
 }
 
 func UpdateAllTokens(signedToken string, signedRefreshToken string, userID string){
@@ -44,7 +44,7 @@ const CheckoutPage: React.FC = () => {
     city: '',
     state: '',
     zipCode: '',
-    country: 'United States',
+    country: 'US',
     cardNumber: '',
     expiryDate: '',
     cvv: '',
@@ -155,13 +155,15 @@ const CheckoutPage: React.FC = () => {
       // Create new address if needed
       if (useNewAddress) {
         const newAddress: Omit<Address, '_id'> = {
-          house_name: form.street,
+          recipient_name: form.cardholderName,
           street_name: form.street,
           city_name: form.city,
-          pin_code: form.zipCode
+          region: form.state,
+          postal_code: form.zipCode,
+          country: form.country
         };
         
-        const createdAddress = await addressAPI.addAddress(user.user_id, newAddress);
+        const createdAddress = await addressAPI.addAddress(newAddress);
         addressId = createdAddress._id;
       }
       
@@ -305,7 +307,7 @@ const CheckoutPage: React.FC = () => {
                       >
                         {addresses.map((address) => (
                           <option key={address._id} value={address._id}>
-                            {address.house_name}, {address.street_name}, {address.city_name} {address.pin_code}
+                            {address.street_name}, {address.city_name} {address.postal_code}, {address.country}
                           </option>
                         ))}
                       </select>
@@ -349,7 +351,8 @@ const CheckoutPage: React.FC = () => {
                         required
                       />
                       <Input
-                        label="Country"
+                        label="Country code"
+                        placeholder="US"
                         value={form.country}
                         onChange={(e) => handleInputChange('country', e.target.value)}
                         error={errors.country}
@@ -103,23 +103,23 @@ export const cartAPI = {
 
 // Address API
 export const addressAPI = {
-  addAddress: async (userId: string, address: Omit<Address, '_id'>): Promise<any> => {
-    const response = await api.post(`/addaddress?id=${userId}`, address);
+  getAddresses: async (): Promise<Address[]> => {
+    const response = await api.get('/addresses');
     return response.data;
   },
 
-  editHomeAddress: async (userId: string, address: Omit<Address, '_id'>): Promise<any> => {
-    const response = await api.put(`/edithomeaddress?id=${userId}`, address);
+  addAddress: async (address: Omit<Address, '_id'>): Promise<Address> => {
+    const response = await api.post('/addresses', address);
     return response.data;
   },
 
-  editWorkAddress: async (userId: string, address: Omit<Address, '_id'>): Promise<any> => {
-    const response = await api.put(`/editworkaddress?id=${userId}`, address);
+  updateAddress: async (addressId: string, address: Partial<Omit<Address, '_id'>>): Promise<Address> => {
+    const response = await api.patch(`/addresses/${addressId}`, address);
     return response.data;
   },
 
-  deleteAddress: async (userId: string): Promise<any> => {
-    const response = await api.get(`/deleteaddresses?id=${userId}`);
+  deleteAddress: async (addressId: string): Promise<any> => {
+    const response = await api.delete(`/addresses/${addressId}`);
     return response.data;
   },
 };
@@ -16,10 +16,18 @@ export interface ProductUser {
 
 export interface Address {
   _id: string;
-  house_name: string;
+  label?: string;
+  recipient_name: string;
+  phone?: string;
+  house_name?: string;
   street_name: string;
+  line_2?: string;
   city_name: string;
-  pin_code: string;
+  region?: string;
+  postal_code?: string;
+  country: string;
+  default_shipping?: boolean;
+  default_billing?: boolean;
 }
 
 export interface Payment {
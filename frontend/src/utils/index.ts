@@ -110,9 +110,9 @@ export function calculateCartTotal(items: Array<{ price: number; quantity?: numb
 
 // Handle API errors
 export function getErrorMessage(error: any): string {
+  if (error.response?.data?.message) return error.response.data.message;
   if (error.response?.data?.Error) return error.response.data.Error;
   if (error.response?.data?.error) return error.response.data.error;
-  if (error.response?.data?.message) return error.response.data.message;
   if (error.message) return error.message;
   return 'An unexpected error occurred';
 }
\ No newline at end of file